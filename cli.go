@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/driver"
+)
+
+// time a command waits for the admin or control API of the plugin
+const adminTimeout = 10 * time.Second
+
+// configFlags are the flags locating the config, sockets and state of a
+// plugin instance, shared by the daemon and the commands.
+type configFlags struct {
+	fs            *flag.FlagSet
+	file          *string
+	socket        *string
+	adminSocket   *string
+	controlSocket *string
+	stateDir      *string
+	stateBackend  *string
+}
+
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	return &configFlags{
+		fs: fs,
+		file: fs.String("config", "",
+			"YAML or JSON config file, overridden by the flags given"),
+		socket: fs.String("socket", defaultConfig.Socket,
+			"plugin name served in /run/docker/plugins, or socket path"),
+		adminSocket: fs.String("admin-socket", defaultConfig.AdminSocket,
+			"socket of the admin API, by default derived from the plugin socket"),
+		controlSocket: fs.String("control-socket", defaultConfig.ControlSocket,
+			"socket of the control API releasing VFs, by default derived from the plugin socket"),
+		stateDir: fs.String("state-dir", defaultConfig.StateDir,
+			"directory networks and endpoints are persisted in"),
+		stateBackend: fs.String("state-backend", defaultConfig.StateBackend,
+			"file or bolt, networks kept in files are imported into bolt"),
+	}
+}
+
+// load reads the config file if one is given, and overrides its settings
+// with the flags given.
+func (f *configFlags) load() (*driver.Config, error) {
+	config := driver.DefaultConfig()
+	if *f.file != "" {
+		var err error
+		config, err = driver.LoadConfig(*f.file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "socket":
+			config.Socket = *f.socket
+		case "admin-socket":
+			config.AdminSocket = *f.adminSocket
+		case "control-socket":
+			config.ControlSocket = *f.controlSocket
+		case "state-dir":
+			config.StateDir = *f.stateDir
+		case "state-backend":
+			config.StateBackend = *f.stateBackend
+		}
+	})
+	return config, nil
+}
+
+// stringList collects the values of a repeated flag.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+type command struct {
+	usage string
+	help  string
+	run   func(c *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"list-networks": {"", "list networks with their endpoints", runListNetworks},
+	"list-vfs":      {"--pf <pf>", "list the free and allocated VFs of a PF", runListVfs},
+	"show-endpoint": {"<id>", "show an endpoint, the ID may be abbreviated", runShowEndpoint},
+	"release-vf":    {"<pf> <index>", "free a VF no endpoint holds, such as a quarantined one", runReleaseVf},
+	"doctor":        {"[--pf <pf>]...", "check the host and Docker for running the plugin", runDoctor},
+}
+
+var commandOrder = []string{"list-networks", "list-vfs", "show-endpoint", "release-vf", "doctor"}
+
+// cli runs a command against a plugin instance, through its admin API or,
+// while it is not running, its state store. Releasing VFs goes through its
+// control API.
+type cli struct {
+	config  *driver.Config
+	client  *http.Client
+	control *http.Client
+}
+
+// pluginDownError is returned when the admin or control API is not
+// reachable.
+type pluginDownError struct {
+	err error
+}
+
+func (e *pluginDownError) Error() string {
+	return fmt.Sprintf("plugin not running: %v", e.err)
+}
+
+func isPluginDown(err error) bool {
+	_, ok := err.(*pluginDownError)
+	return ok
+}
+
+func commandUsage(out *os.File) {
+	fmt.Fprintf(out, "Commands, run with -h for their flags:\n")
+	for _, name := range commandOrder {
+		fmt.Fprintf(out, "  %s %s\n\t%s\n", name, commands[name].usage, commands[name].help)
+	}
+}
+
+// runCommand runs the command given as first argument and returns the
+// exit code of the binary.
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", args[0])
+		commandUsage(os.Stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags := addConfigFlags(fs)
+	var pfs stringList
+	if args[0] == "list-vfs" || args[0] == "doctor" {
+		fs.Var(&pfs, "pf", "PF netdevice or glob pattern, may be repeated for doctor")
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n", os.Args[0], args[0], cmd.usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	config, err := flags.load()
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %s\n", err.Error())
+		return 2
+	}
+
+	c := &cli{
+		config:  config,
+		client:  socketClient(config.AdminSocketPath()),
+		control: socketClient(config.ControlSocketPath()),
+	}
+	cmdArgs := fs.Args()
+	if len(pfs) > 0 {
+		cmdArgs = append([]string(pfs), cmdArgs...)
+	}
+	err = cmd.run(c, cmdArgs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err.Error())
+		return 1
+	}
+	return 0
+}
+
+// socketClient returns a client sending every request to a socket.
+func socketClient(socket string) *http.Client {
+	dialer := net.Dialer{}
+	return &http.Client{
+		Timeout: adminTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+func (c *cli) request(method string, path string, out interface{}) error {
+	return doRequest(c.client, method, path, out)
+}
+
+func doRequest(client *http.Client, method string, path string, out interface{}) error {
+	req, err := http.NewRequest(method, "http://admin"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &pluginDownError{err: err}
+	}
+	defer resp.Body.Close()
+
+	rawData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", strings.TrimSpace(string(rawData)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(rawData, out)
+}
+
+// withStore runs fn with the state store, for reading the state while the
+// plugin is not running. The store is opened read only, so the state is
+// left as the plugin will find it.
+func (c *cli) withStore(fn func(store driver.Store) error) error {
+	_, err := os.Stat(c.config.StateDir)
+	if err != nil {
+		return fmt.Errorf("Fail to read state: %v", err)
+	}
+	store, err := driver.OpenStoreReadOnly(c.config.StateBackend, c.config.StateDir)
+	if err != nil {
+		return fmt.Errorf("Fail to open state: %v", err)
+	}
+	defer store.Close()
+	return fn(store)
+}
+
+// networks returns the networks from the plugin, or from the state store
+// while it is not running.
+func (c *cli) networks() ([]driver.AdminNetwork, error) {
+	var networks []driver.AdminNetwork
+	err := c.request(http.MethodGet, "/networks", &networks)
+	if !isPluginDown(err) {
+		return networks, err
+	}
+
+	fmt.Fprintf(os.Stderr, "Plugin not running, reading %s\n", c.config.StateDir)
+	err = c.withStore(func(store driver.Store) error {
+		var err error
+		networks, err = driver.StoreNetworks(driver.NewSysfsHardware(), store)
+		return err
+	})
+	return networks, err
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func runListNetworks(c *cli, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("no arguments expected")
+	}
+	networks, err := c.networks()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NETWORK\tMODE\tPF\tVLAN\tPREFIX\tENDPOINTS\n")
+	for _, nw := range networks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%d\n", shortID(nw.ID), nw.Mode,
+			strings.Join(nw.Pfs, ","), nw.Vlan, nw.Prefix, len(nw.Endpoints))
+	}
+	return w.Flush()
+}
+
+func runListVfs(c *cli, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected one PF given with --pf")
+	}
+	pf := args[0]
+
+	var dev *driver.AdminPfDevice
+	err := c.request(http.MethodGet, "/pfs/"+pf, &dev)
+	if isPluginDown(err) {
+		fmt.Fprintf(os.Stderr, "Plugin not running, reading %s and sysfs\n", c.config.StateDir)
+		err = c.withStore(func(store driver.Store) error {
+			var err error
+			dev, err = driver.StorePfDevice(driver.NewSysfsHardware(), store, pf)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("PF %s: %d of %d VFs free, used by %d networks\n", dev.Name, dev.FreeVfs, dev.TotalVfs, dev.RefCount)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "VF\tPCI ADDRESS\tSTATE\tENDPOINT\n")
+	for _, vf := range dev.Vfs {
+		state := "free"
+		endpointID := vf.EndpointID
+		switch {
+		case vf.Quarantined != "":
+			state = "quarantined: " + vf.Quarantined
+		case vf.ReservedFor != "":
+			state = "reserved"
+			endpointID = vf.ReservedFor
+		case vf.Allocated:
+			state = "allocated"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", vf.Index, vf.PciAddress, state, orDash(shortID(endpointID)))
+	}
+	return w.Flush()
+}
+
+func runShowEndpoint(c *cli, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected an endpoint ID")
+	}
+	networks, err := c.networks()
+	if err != nil {
+		return err
+	}
+
+	var matches []driver.AdminEndpoint
+	for _, nw := range networks {
+		for _, ep := range nw.Endpoints {
+			if ep.ID == args[0] {
+				matches = []driver.AdminEndpoint{ep}
+				break
+			}
+			if strings.HasPrefix(ep.ID, args[0]) {
+				matches = append(matches, ep)
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("endpoint %s not found", args[0])
+	case 1:
+	default:
+		return fmt.Errorf("endpoint ID %s is ambiguous, %d endpoints match", args[0], len(matches))
+	}
+
+	rawData, err := json.MarshalIndent(matches[0], "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(rawData))
+	return nil
+}
+
+func runReleaseVf(c *cli, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected a PF and a VF index")
+	}
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid VF index %s", args[1])
+	}
+
+	err = doRequest(c.control, http.MethodPost, fmt.Sprintf("/pfs/%s/vfs/%d/release", args[0], index), nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Released VF %d of %s\n", index, args[0])
+	return nil
+}
+
+func runDoctor(c *cli, args []string) error {
+	var checks []driver.DoctorCheck
+
+	check := driver.DoctorCheck{Name: "plugin running", Detail: c.config.AdminSocketPath()}
+	var networks []driver.AdminNetwork
+	check.Err = c.request(http.MethodGet, "/networks", &networks)
+	if down, ok := check.Err.(*pluginDownError); ok {
+		check.Err = down.err
+	}
+	checks = append(checks, check)
+
+	pfs := args
+	if len(pfs) == 0 {
+		// the PFs of the networks, read from the state while not running
+		if check.Err != nil {
+			networks, _ = c.networks()
+		}
+		seen := make(map[string]bool)
+		for _, nw := range networks {
+			for _, pf := range nw.Pfs {
+				if pf != "" && !seen[pf] {
+					seen[pf] = true
+					pfs = append(pfs, pf)
+				}
+			}
+		}
+	}
+
+	checks = append(checks, driver.Doctor(driver.NewSysfsHardware(), pfs)...)
+	for _, check := range checks {
+		fmt.Println(check)
+	}
+	if len(pfs) == 0 {
+		fmt.Println("No PFs to check, give them with --pf")
+	}
+	if driver.DoctorFailed(checks) {
+		return fmt.Errorf("some checks failed")
+	}
+	return nil
+}
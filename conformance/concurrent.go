@@ -0,0 +1,214 @@
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// containers each worker starts and removes one after another
+const lifecyclesPerWorker = 5
+
+type concurrentNetwork struct {
+	id      string
+	options map[string]interface{}
+	subnet  int
+	// number of containers running on the network at the same time
+	workers int
+}
+
+// RunConcurrentLifecycles starts and removes containers on several networks
+// in parallel, with networks sharing a PF and a network spanning two PFs.
+// Its test checks the locking of the driver when run with the race
+// detector:
+//
+//	go test -race ./conformance/
+func RunConcurrentLifecycles() error {
+	pfs := []Pf{
+		{Name: "ens1f0", TotalVfs: 8},
+		{Name: "ens1f1", TotalVfs: 8},
+		{Name: "ens2f0", TotalVfs: 8},
+		{Name: "ens2f1", TotalVfs: 8},
+	}
+	networks := []concurrentNetwork{
+		{
+			id:      "cccc000000000000000000000000000000000000000000000000000000000001",
+			options: map[string]interface{}{"netdevice": "ens1f*", "numvfs": "8", "alloc_strategy": "round-robin"},
+			subnet:  1,
+			workers: 16,
+		},
+		{
+			id:      "cccc000000000000000000000000000000000000000000000000000000000002",
+			options: map[string]interface{}{"netdevice": "ens2f0", "numvfs": "8", "vlan": "10"},
+			subnet:  2,
+			workers: 4,
+		},
+		{
+			id:      "cccc000000000000000000000000000000000000000000000000000000000003",
+			options: map[string]interface{}{"netdevice": "ens2f0", "numvfs": "8", "vlan": "20"},
+			subnet:  3,
+			workers: 4,
+		},
+		{
+			id:      "cccc000000000000000000000000000000000000000000000000000000000004",
+			options: map[string]interface{}{"netdevice": "ens2f1", "numvfs": "8", "privileged": "1"},
+			subnet:  4,
+			workers: 8,
+		},
+	}
+
+	p, err := startPlugin(pfs)
+	if err != nil {
+		return err
+	}
+	defer p.stop()
+
+	for _, nw := range networks {
+		req := network.CreateNetworkRequest{
+			NetworkID: nw.id,
+			Options: map[string]interface{}{
+				"com.docker.network.generic": nw.options,
+			},
+			IPv4Data: []*network.IPAMData{{
+				AddressSpace: "LocalDefault",
+				Pool:         fmt.Sprintf("10.%d.0.0/16", nw.subnet),
+				Gateway:      fmt.Sprintf("10.%d.0.1/16", nw.subnet),
+			}},
+		}
+		err = p.call("NetworkDriver.CreateNetwork", &req, nil)
+		if err != nil {
+			return fmt.Errorf("create network %s: %v", nw.id, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var errs []error
+	// VF PCI address to the endpoint holding it
+	vfOwners := make(map[string]string)
+
+	for _, nw := range networks {
+		for worker := 0; worker < nw.workers; worker++ {
+			wg.Add(1)
+			go func(nw concurrentNetwork, worker int) {
+				defer wg.Done()
+				for i := 0; i < lifecyclesPerWorker; i++ {
+					err := p.containerLifecycle(nw, worker, i, &lock, vfOwners)
+					if err != nil {
+						lock.Lock()
+						errs = append(errs, err)
+						lock.Unlock()
+						return
+					}
+				}
+			}(nw, worker)
+		}
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("%d workers failed, first: %v", len(errs), errs[0])
+	}
+
+	for _, nw := range networks {
+		err = p.call("NetworkDriver.DeleteNetwork", &network.DeleteNetworkRequest{NetworkID: nw.id}, nil)
+		if err != nil {
+			return fmt.Errorf("delete network %s: %v", nw.id, err)
+		}
+	}
+
+	// every network is gone, so SR-IOV enabled through numvfs must be off
+	for _, pf := range pfs {
+		if p.hw.IsSriovEnabled(pf.Name) {
+			return fmt.Errorf("sriov still enabled on %s", pf.Name)
+		}
+	}
+	return nil
+}
+
+// containerLifecycle creates, joins, leaves and deletes an endpoint like
+// docker run and docker rm do, checking that no VF is handed out twice.
+func (p *plugin) containerLifecycle(nw concurrentNetwork, worker int, iteration int,
+	lock *sync.Mutex, vfOwners map[string]string) error {
+	endpointID := fmt.Sprintf("%s-%02d-%02d", nw.id[:12], worker, iteration)
+
+	createReq := network.CreateEndpointRequest{
+		NetworkID:  nw.id,
+		EndpointID: endpointID,
+		Interface: &network.EndpointInterface{
+			Address: fmt.Sprintf("10.%d.%d.%d/16", nw.subnet, worker+1, iteration+1),
+		},
+		Options: map[string]interface{}{},
+	}
+	err := p.call("NetworkDriver.CreateEndpoint", &createReq, nil)
+	if err != nil {
+		return fmt.Errorf("create endpoint %s: %v", endpointID, err)
+	}
+
+	info := network.InfoResponse{}
+	err = p.call("NetworkDriver.EndpointOperInfo",
+		&network.InfoRequest{NetworkID: nw.id, EndpointID: endpointID}, &info)
+	if err != nil {
+		return fmt.Errorf("endpoint info %s: %v", endpointID, err)
+	}
+	pciAddr := info.Value["pciAddress"]
+
+	lock.Lock()
+	owner, inUse := vfOwners[pciAddr]
+	vfOwners[pciAddr] = endpointID
+	lock.Unlock()
+	if inUse {
+		return fmt.Errorf("VF %s of endpoint %s is already used by %s", pciAddr, endpointID, owner)
+	}
+
+	joinReq := network.JoinRequest{
+		NetworkID:  nw.id,
+		EndpointID: endpointID,
+		SandboxKey: "/var/run/docker/netns/" + endpointID,
+		Options:    map[string]interface{}{},
+	}
+	join := network.JoinResponse{}
+	err = p.call("NetworkDriver.Join", &joinReq, &join)
+	if err != nil {
+		return fmt.Errorf("join %s: %v", endpointID, err)
+	}
+	if join.InterfaceName.SrcName != info.Value["srcName"] {
+		return fmt.Errorf("join %s returned %s, expected %s",
+			endpointID, join.InterfaceName.SrcName, info.Value["srcName"])
+	}
+
+	err = p.call("NetworkDriver.Leave",
+		&network.LeaveRequest{NetworkID: nw.id, EndpointID: endpointID}, nil)
+	if err != nil {
+		return fmt.Errorf("leave %s: %v", endpointID, err)
+	}
+
+	lock.Lock()
+	delete(vfOwners, pciAddr)
+	lock.Unlock()
+
+	err = p.call("NetworkDriver.DeleteEndpoint",
+		&network.DeleteEndpointRequest{NetworkID: nw.id, EndpointID: endpointID}, nil)
+	if err != nil {
+		return fmt.Errorf("delete endpoint %s: %v", endpointID, err)
+	}
+	return nil
+}
+
+// call sends a request to the plugin and decodes its response into resp,
+// unless resp is nil.
+func (p *plugin) call(call string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	rawData, err := p.post(call, body)
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(rawData, resp)
+}
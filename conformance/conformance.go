@@ -0,0 +1,284 @@
+// Package conformance replays request sequences of the Docker daemon
+// against the plugin, as run by go test. The requests go through the JSON
+// over HTTP protocol on a temporary Unix socket, to a driver running on
+// fake PFs, so that changes of go-plugins-helpers or libnetwork which break
+// the protocol are noticed without a NIC or a Docker daemon.
+//
+// The recordings are written by hand after the requests and options the
+// daemon sends for docker network create, docker run and docker rm, as
+// described by each of them, rather than captured from a running daemon.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/driver"
+	"github.com/FoxDenHome/docker-sriov-plugin/internal/fakehw"
+)
+
+// content type of requests sent by the Docker daemon to plugins
+const pluginContentType = "application/vnd.docker.plugins.v1.2+json"
+
+const requestTimeout = 10 * time.Second
+
+//go:embed recordings/*.json
+var recordings embed.FS
+
+// Pf is a fake PF a recording runs on.
+type Pf struct {
+	Name     string
+	TotalVfs int
+	NumVfs   int
+	NumaNode int
+}
+
+// Step is a request of the Docker daemon and the expected reply.
+type Step struct {
+	// plugin method, such as NetworkDriver.CreateNetwork
+	Call    string
+	Request json.RawMessage
+	// fields the response must have, other fields are not checked
+	Response json.RawMessage `json:",omitempty"`
+	// error the plugin must reply with instead of a response
+	Err string `json:",omitempty"`
+}
+
+type Recording struct {
+	Name        string
+	Description string
+	Pfs         []Pf
+	Steps       []Step
+}
+
+// LoadRecordings returns the recordings of the recordings directory.
+func LoadRecordings() ([]*Recording, error) {
+	var recs []*Recording
+
+	files, err := recordings.ReadDir("recordings")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		rawData, err := recordings.ReadFile("recordings/" + file.Name())
+		if err != nil {
+			return nil, err
+		}
+		rec := Recording{}
+		err = json.Unmarshal(rawData, &rec)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to parse recording %s: %v", file.Name(), err)
+		}
+		if rec.Name == "" {
+			rec.Name = strings.TrimSuffix(file.Name(), ".json")
+		}
+		recs = append(recs, &rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Name < recs[j].Name })
+	return recs, nil
+}
+
+// plugin is a driver with fresh fake hardware and state, served on a
+// temporary socket.
+type plugin struct {
+	dir    string
+	d      io.Closer // the driver, closing its store
+	hw     *fakehw.Hardware
+	client *http.Client
+	l      net.Listener
+}
+
+func startPlugin(pfs []Pf) (*plugin, error) {
+	dir, err := ioutil.TempDir("", "sriov-conformance")
+	if err != nil {
+		return nil, err
+	}
+
+	config := driver.DefaultConfig()
+	config.StateDir = filepath.Join(dir, "state")
+
+	hw := fakehw.New()
+	for _, pf := range pfs {
+		hw.AddPf(pf.Name, pf.TotalVfs, pf.NumVfs).NumaNode = pf.NumaNode
+	}
+
+	d, err := driver.NewDriver(hw, config)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	socket := filepath.Join(dir, "sriov.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go network.NewHandler(driver.NewServer(d, socket)).Serve(l)
+
+	p := &plugin{
+		dir: dir,
+		d:   d,
+		hw:  hw,
+		l:   l,
+		client: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+	return p, nil
+}
+
+func (p *plugin) stop() {
+	p.l.Close()
+	p.d.Close()
+	os.RemoveAll(p.dir)
+}
+
+// post sends a request to the plugin and returns the raw response, or the
+// error the plugin replied with.
+func (p *plugin) post(call string, body []byte) ([]byte, error) {
+	resp, err := p.client.Post("http://plugin/"+call, pluginContentType, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	rawData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := network.ErrorResponse{}
+		err = json.Unmarshal(rawData, &errResp)
+		if err != nil {
+			return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(rawData)))
+		}
+		return nil, &pluginError{errResp.Err}
+	}
+	return rawData, nil
+}
+
+// pluginError is an error the plugin replied with.
+type pluginError struct {
+	msg string
+}
+
+func (e *pluginError) Error() string {
+	return e.msg
+}
+
+// RunRecording replays the steps of a recording against a fresh plugin.
+func RunRecording(rec *Recording) error {
+	p, err := startPlugin(rec.Pfs)
+	if err != nil {
+		return err
+	}
+	defer p.stop()
+
+	for i, step := range rec.Steps {
+		err = replayStep(p, &step)
+		if err != nil {
+			return fmt.Errorf("step %d %s: %v", i+1, step.Call, err)
+		}
+	}
+	return nil
+}
+
+func replayStep(p *plugin, step *Step) error {
+	body := []byte(step.Request)
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+
+	rawData, err := p.post(step.Call, body)
+	if errResp, ok := err.(*pluginError); ok {
+		if step.Err == "" {
+			return fmt.Errorf("unexpected error: %s", errResp.msg)
+		}
+		if errResp.msg != step.Err {
+			return fmt.Errorf("error %q, expected %q", errResp.msg, step.Err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if step.Err != "" {
+		return fmt.Errorf("succeeded, expected error %q", step.Err)
+	}
+
+	if len(step.Response) == 0 {
+		return nil
+	}
+	var expected, actual interface{}
+	err = json.Unmarshal(step.Response, &expected)
+	if err != nil {
+		return fmt.Errorf("invalid expected response: %v", err)
+	}
+	err = json.Unmarshal(rawData, &actual)
+	if err != nil {
+		return fmt.Errorf("invalid response %s: %v", strings.TrimSpace(string(rawData)), err)
+	}
+	return matchJSON("response", expected, actual)
+}
+
+// matchJSON checks that actual has all fields of expected with the same
+// values. Arrays must have the same length.
+func matchJSON(path string, expected interface{}, actual interface{}) error {
+	switch expectedValue := expected.(type) {
+	case map[string]interface{}:
+		actualValue, ok := actual.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is %v, expected an object", path, actual)
+		}
+		for key, value := range expectedValue {
+			field, ok := actualValue[key]
+			if !ok {
+				return fmt.Errorf("%s.%s is missing", path, key)
+			}
+			err := matchJSON(path+"."+key, value, field)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		actualValue, ok := actual.([]interface{})
+		if !ok || len(actualValue) != len(expectedValue) {
+			return fmt.Errorf("%s is %v, expected %v", path, actual, expected)
+		}
+		for i := range expectedValue {
+			err := matchJSON(fmt.Sprintf("%s[%d]", path, i), expectedValue[i], actualValue[i])
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("%s is %v, expected %v", path, actual, expected)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package conformance
+
+import (
+	"testing"
+)
+
+func TestRecordings(t *testing.T) {
+	recs, err := LoadRecordings()
+	if err != nil {
+		t.Fatalf("LoadRecordings: %v", err)
+	}
+	if len(recs) == 0 {
+		t.Fatalf("no recordings found")
+	}
+
+	for _, rec := range recs {
+		rec := rec
+		t.Run(rec.Name, func(t *testing.T) {
+			t.Parallel()
+			err := RunRecording(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestConcurrentLifecycles(t *testing.T) {
+	t.Parallel()
+	err := RunConcurrentLifecycles()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
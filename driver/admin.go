@@ -0,0 +1,561 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-connections/sockets"
+)
+
+// directory admin sockets are served in, apart from the plugin sockets
+// so that Docker does not take them for plugins
+const adminSockDir = "/run/docker-sriov-plugin"
+
+// AdminNetwork is a network as shown by the admin API.
+type AdminNetwork struct {
+	ID            string
+	Mode          string
+	Pfs           []string
+	Vlan          int  `json:",omitempty"`
+	Privileged    bool `json:",omitempty"`
+	Prefix        string
+	AllocStrategy string `json:",omitempty"`
+	VfDriver      string `json:",omitempty"`
+	Endpoints     []AdminEndpoint
+}
+
+// AdminEndpoint is an endpoint as shown by the admin API. Endpoints of
+// passthrough networks have no VF.
+type AdminEndpoint struct {
+	ID           string
+	NetworkID    string
+	Pf           string
+	VfIndex      *int   `json:",omitempty"`
+	VfPciAddress string `json:",omitempty"`
+	VfNetdev     string `json:",omitempty"`
+	Mac          string `json:",omitempty"`
+	Address      string `json:",omitempty"`
+	SandboxKey   string `json:",omitempty"`
+}
+
+// AdminPfDevice is a PF used by sriov networks as shown by the admin API.
+type AdminPfDevice struct {
+	Name            string
+	RefCount        int
+	TotalVfs        int
+	FreeVfs         int
+	NumaNode        int
+	EnabledByPlugin bool
+	Vfs             []AdminVf
+}
+
+// AdminVf is a VF of a PF as shown by the admin API.
+type AdminVf struct {
+	Index      int
+	PciAddress string
+	Allocated  bool
+	// endpoint the VF is allocated to
+	EndpointID string `json:",omitempty"`
+	// reason the VF could not be reset on release
+	Quarantined string `json:",omitempty"`
+	// endpoint of a network which was not restored the VF is kept for
+	ReservedFor string `json:",omitempty"`
+}
+
+// AdminSocketPath returns the socket the admin API of a plugin instance
+// is served on.
+func (config *Config) AdminSocketPath() string {
+	if config.AdminSocket != "" {
+		return config.AdminSocket
+	}
+	if filepath.IsAbs(config.Socket) {
+		return strings.TrimSuffix(config.Socket, ".sock") + "-admin.sock"
+	}
+	return filepath.Join(adminSockDir, config.Socket+".sock")
+}
+
+// adminNetworks returns the networks of the driver with their endpoints.
+func (d *driver) adminNetworks() []AdminNetwork {
+	networks := []AdminNetwork{}
+
+	d.RLock()
+	for nid, nw := range d.networks {
+		genNw := nw.getGenNw()
+		adminNw := AdminNetwork{
+			ID:        nid,
+			Mode:      genNw.mode,
+			Pfs:       []string{genNw.ndevName},
+			Prefix:    genNw.ethPrefix,
+			Endpoints: []AdminEndpoint{},
+		}
+		if sriovNw, ok := nw.(*sriovNetwork); ok {
+			adminNw.Pfs = sriovNw.pfNames
+			adminNw.Vlan = sriovNw.vlan
+			adminNw.Privileged = sriovNw.privileged > 0
+			adminNw.AllocStrategy = sriovNw.allocation
+			adminNw.VfDriver = sriovNw.vfDriver
+		}
+
+		genNw.lock.Lock()
+		for id, endpoint := range genNw.ndevEndpoints {
+			adminEp := endpoint.adminEndpoint(id, nid)
+			if adminEp.Pf == "" {
+				// passthrough endpoints take the netdevice itself
+				adminEp.Pf = genNw.ndevName
+			}
+			adminNw.Endpoints = append(adminNw.Endpoints, adminEp)
+		}
+		genNw.lock.Unlock()
+
+		sort.Slice(adminNw.Endpoints, func(i, j int) bool {
+			return adminNw.Endpoints[i].ID < adminNw.Endpoints[j].ID
+		})
+		networks = append(networks, adminNw)
+	}
+	d.RUnlock()
+
+	// the MAC address is read from the PF, without holding the locks
+	for i := range networks {
+		for j := range networks[i].Endpoints {
+			d.fillEndpointMac(&networks[i].Endpoints[j])
+		}
+	}
+
+	sort.Slice(networks, func(i, j int) bool { return networks[i].ID < networks[j].ID })
+	return networks
+}
+
+func (endpoint *ptEndpoint) adminEndpoint(id string, nid string) AdminEndpoint {
+	adminEp := AdminEndpoint{
+		ID:         id,
+		NetworkID:  nid,
+		Pf:         endpoint.pfName,
+		VfNetdev:   endpoint.devName,
+		Mac:        endpoint.HardwareAddr,
+		Address:    endpoint.Address,
+		SandboxKey: endpoint.sandboxKey,
+	}
+	if endpoint.vfObj != nil {
+		index := endpoint.vfObj.Index
+		adminEp.VfIndex = &index
+		adminEp.VfPciAddress = endpoint.vfObj.PciAddress
+	}
+	return adminEp
+}
+
+func (d *driver) fillEndpointMac(adminEp *AdminEndpoint) {
+	if adminEp.Mac != "" || adminEp.VfIndex == nil {
+		return
+	}
+	info, err := d.hw.GetVfInfo(adminEp.Pf, *adminEp.VfIndex)
+	if err == nil && info.Mac != nil && info.Mac.String() != "00:00:00:00:00:00" {
+		adminEp.Mac = info.Mac.String()
+		return
+	}
+	// the netdevice is found only while it is not in a container
+	mac, err := d.hw.GetVfMacAddress(adminEp.Pf, *adminEp.VfIndex)
+	if err == nil {
+		adminEp.Mac = mac
+	}
+}
+
+// adminEndpoints returns the endpoints of all networks.
+func (d *driver) adminEndpoints() []AdminEndpoint {
+	endpoints := []AdminEndpoint{}
+	for _, nw := range d.adminNetworks() {
+		endpoints = append(endpoints, nw.Endpoints...)
+	}
+	return endpoints
+}
+
+// adminPfDevices returns the PFs used by sriov networks with their VFs.
+func (d *driver) adminPfDevices() []AdminPfDevice {
+	devices := []AdminPfDevice{}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	// PF and VF index to the endpoint holding the VF
+	vfOwners := make(map[string]map[int]string)
+	for _, nw := range d.networks {
+		genNw := nw.getGenNw()
+		genNw.lock.Lock()
+		for id, endpoint := range genNw.ndevEndpoints {
+			if endpoint.vfObj == nil {
+				continue
+			}
+			if vfOwners[endpoint.pfName] == nil {
+				vfOwners[endpoint.pfName] = make(map[int]string)
+			}
+			vfOwners[endpoint.pfName][endpoint.vfObj.Index] = id
+		}
+		genNw.lock.Unlock()
+	}
+
+	for name, dev := range d.pfDevices {
+		adminDev := AdminPfDevice{
+			Name:            name,
+			RefCount:        dev.nwUseRefCount,
+			NumaNode:        dev.numaNode,
+			EnabledByPlugin: dev.enabledByPlugin,
+		}
+
+		dev.lock.Lock()
+		for _, vf := range dev.pfHandle.List {
+			adminVf := AdminVf{
+				Index:       vf.Index,
+				PciAddress:  vf.PciAddress,
+				Allocated:   vf.Allocated,
+				EndpointID:  vfOwners[name][vf.Index],
+				Quarantined: dev.quarantinedVfs[vf.Index],
+			}
+			if reserved := d.reservedVfs[vf.PciAddress]; reserved != nil {
+				adminVf.ReservedFor = reserved.EndpointID
+			}
+			adminDev.Vfs = append(adminDev.Vfs, adminVf)
+			if !vf.Allocated {
+				adminDev.FreeVfs++
+			}
+		}
+		dev.lock.Unlock()
+		adminDev.TotalVfs = len(adminDev.Vfs)
+
+		sort.Slice(adminDev.Vfs, func(i, j int) bool { return adminDev.Vfs[i].Index < adminDev.Vfs[j].Index })
+		devices = append(devices, adminDev)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices
+}
+
+// StoreNetworks returns the networks persisted in a store with their
+// endpoints, for showing the state while the plugin is not running.
+func StoreNetworks(hw Hardware, store Store) ([]AdminNetwork, error) {
+	networks := []AdminNetwork{}
+
+	err := store.View(func(tx StoreTx) error {
+		nwList, err := tx.Networks()
+		if err != nil {
+			return err
+		}
+		for nid, nw := range nwList {
+			epList, err := tx.Endpoints(nid)
+			if err != nil {
+				return err
+			}
+			networks = append(networks, storeNetwork(hw, nid, nw, epList))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(networks, func(i, j int) bool { return networks[i].ID < networks[j].ID })
+	return networks, nil
+}
+
+func storeNetwork(hw Hardware, nid string, nw *DbNetworkInfo, epList map[string]*DbEndpointInfo) AdminNetwork {
+	adminNw := AdminNetwork{
+		ID:            nid,
+		Mode:          nw.Mode,
+		Pfs:           storeNetworkPfs(hw, nw),
+		Vlan:          nw.Vlan,
+		Privileged:    nw.Privileged,
+		Prefix:        nw.Prefix,
+		AllocStrategy: nw.AllocStrategy,
+		VfDriver:      nw.VfDriver,
+		Endpoints:     []AdminEndpoint{},
+	}
+	for id, ep := range epList {
+		adminEp := AdminEndpoint{
+			ID:         id,
+			NetworkID:  nid,
+			Pf:         ep.PfNetdev,
+			VfNetdev:   ep.DevName,
+			Address:    ep.Address,
+			SandboxKey: ep.SandboxKey,
+		}
+		if nw.Mode == networkModePT {
+			if adminEp.Pf == "" {
+				adminEp.Pf = nw.Netdev
+			}
+		} else {
+			adminEp.Pf = storeEndpointPf(hw, adminNw.Pfs, ep)
+			index := ep.VfIndex
+			adminEp.VfIndex = &index
+			adminEp.VfPciAddress = ep.VfPciAddress
+		}
+		adminNw.Endpoints = append(adminNw.Endpoints, adminEp)
+	}
+	sort.Slice(adminNw.Endpoints, func(i, j int) bool {
+		return adminNw.Endpoints[i].ID < adminNw.Endpoints[j].ID
+	})
+	return adminNw
+}
+
+// storeNetworkPfs returns the PFs of a stored network, found by their PCI
+// addresses as they may have been renamed, or by expanding its netdevice
+// option.
+func storeNetworkPfs(hw Hardware, nw *DbNetworkInfo) []string {
+	if nw.Mode == networkModePT {
+		return []string{nw.Netdev}
+	}
+
+	var pfNames []string
+	for _, addr := range nw.PfPciAddresses {
+		name, err := hw.GetNetdevByPciAddress(addr)
+		if err != nil {
+			pfNames = nil
+			break
+		}
+		pfNames = append(pfNames, name)
+	}
+	if len(pfNames) > 0 {
+		return pfNames
+	}
+
+	pfNames, err := resolvePfNames(hw, nw.Netdev)
+	if err != nil {
+		return strings.Split(nw.Netdev, ",")
+	}
+	return pfNames
+}
+
+// storeEndpointPf returns the PF of a stored endpoint, the one of the
+// network PFs its VF is found on, as PfNetdev may be stale after a rename
+// and is not stored by older versions.
+func storeEndpointPf(hw Hardware, pfNames []string, ep *DbEndpointInfo) string {
+	if ep.VfPciAddress != "" {
+		for _, name := range pfNames {
+			handle, err := hw.GetPfHandle(name)
+			if err != nil {
+				continue
+			}
+			for _, vf := range handle.List {
+				if vf.PciAddress == ep.VfPciAddress {
+					return name
+				}
+			}
+		}
+	}
+	if ep.PfNetdev != "" {
+		return ep.PfNetdev
+	}
+	return pfNames[0]
+}
+
+// StorePfDevice returns a PF with its VFs read from the hardware, the VFs
+// held by endpoints persisted in a store, or quarantined or reserved by its
+// VF records, being allocated.
+func StorePfDevice(hw Hardware, store Store, pfNetdevName string) (*AdminPfDevice, error) {
+	networks, err := StoreNetworks(hw, store)
+	if err != nil {
+		return nil, err
+	}
+	var vfList map[string]*DbVfInfo
+	err = store.View(func(tx StoreTx) error {
+		var err error
+		vfList, err = tx.Vfs()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	handle, err := hw.GetPfHandle(pfNetdevName)
+	if err != nil {
+		return nil, err
+	}
+
+	vfOwners := make(map[int]string)
+	adminDev := AdminPfDevice{Name: pfNetdevName, NumaNode: hw.GetNumaNode(pfNetdevName)}
+	for _, nw := range networks {
+		used := false
+		for _, ep := range nw.Endpoints {
+			if ep.Pf == pfNetdevName && ep.VfIndex != nil {
+				vfOwners[*ep.VfIndex] = ep.ID
+				used = true
+			}
+		}
+		for _, pf := range nw.Pfs {
+			used = used || pf == pfNetdevName
+		}
+		if used {
+			adminDev.RefCount++
+		}
+	}
+	for _, vf := range handle.List {
+		owner, allocated := vfOwners[vf.Index]
+		adminVf := AdminVf{
+			Index:      vf.Index,
+			PciAddress: vf.PciAddress,
+			Allocated:  allocated,
+			EndpointID: owner,
+		}
+		if info := vfList[vf.PciAddress]; info != nil && !allocated {
+			adminVf.Allocated = true
+			adminVf.Quarantined = info.Quarantined
+			if info.Quarantined == "" {
+				adminVf.ReservedFor = info.EndpointID
+			}
+		}
+		adminDev.Vfs = append(adminDev.Vfs, adminVf)
+		if !adminVf.Allocated {
+			adminDev.FreeVfs++
+		}
+	}
+	adminDev.TotalVfs = len(adminDev.Vfs)
+
+	sort.Slice(adminDev.Vfs, func(i, j int) bool { return adminDev.Vfs[i].Index < adminDev.Vfs[j].Index })
+	return &adminDev, nil
+}
+
+// AdminServer serves a JSON API on the state of a driver:
+//
+//	GET /networks, /networks/<id>   networks with their endpoints
+//	GET /endpoints, /endpoints/<id> endpoints with their VFs
+//	GET /pfs, /pfs/<name>           PFs with their VFs
+//	GET /metrics                    Prometheus metrics
+//
+// It only reads the state, which is changed through the ControlServer.
+type AdminServer struct {
+	d      *driver
+	socket string
+	server *http.Server
+}
+
+func NewAdminServer(d *driver, socket string) *AdminServer {
+	s := &AdminServer{
+		d:      d,
+		socket: socket,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", s.handleNetworks)
+	mux.HandleFunc("/networks/", s.handleNetworks)
+	mux.HandleFunc("/endpoints", s.handleEndpoints)
+	mux.HandleFunc("/endpoints/", s.handleEndpoints)
+	mux.HandleFunc("/pfs", s.handlePfDevices)
+	mux.HandleFunc("/pfs/", s.handlePfDevices)
+	mux.Handle("/metrics", d.metrics.handler())
+	s.server = &http.Server{Handler: mux}
+	return s
+}
+
+// Serve serves the admin API until the server is closed. The socket is
+// only accessible to root.
+func (s *AdminServer) Serve() error {
+	err := os.MkdirAll(filepath.Dir(s.socket), 0755)
+	if err != nil {
+		return err
+	}
+	l, err := sockets.NewUnixSocket(s.socket, 0)
+	if err != nil {
+		return err
+	}
+	err = s.server.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops serving and removes the socket.
+func (s *AdminServer) Close() error {
+	err := s.server.Close()
+	os.Remove(s.socket)
+	return err
+}
+
+// itemName returns the item a request is for, empty for the collection.
+func itemName(r *http.Request, collection string) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, collection), "/")
+}
+
+func (s *AdminServer) handleNetworks(w http.ResponseWriter, r *http.Request) {
+	if !allowRead(w, r) {
+		return
+	}
+	networks := s.d.adminNetworks()
+
+	id := itemName(r, "/networks")
+	if id == "" {
+		writeJSON(w, networks)
+		return
+	}
+	for _, nw := range networks {
+		if nw.ID == id {
+			writeJSON(w, nw)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("network %s not found", id), http.StatusNotFound)
+}
+
+func (s *AdminServer) handleEndpoints(w http.ResponseWriter, r *http.Request) {
+	if !allowRead(w, r) {
+		return
+	}
+	endpoints := s.d.adminEndpoints()
+
+	id := itemName(r, "/endpoints")
+	if id == "" {
+		writeJSON(w, endpoints)
+		return
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.ID == id {
+			writeJSON(w, endpoint)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("endpoint %s not found", id), http.StatusNotFound)
+}
+
+func (s *AdminServer) handlePfDevices(w http.ResponseWriter, r *http.Request) {
+	if !allowRead(w, r) {
+		return
+	}
+	devices := s.d.adminPfDevices()
+
+	name := itemName(r, "/pfs")
+
+	if name == "" {
+		writeJSON(w, devices)
+		return
+	}
+	for _, dev := range devices {
+		if dev.Name == name {
+			writeJSON(w, dev)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("pf %s not found", name), http.StatusNotFound)
+}
+
+func allowRead(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	rawData, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(append(rawData, '\n'))
+	if err != nil {
+		logger.WithError(err).Warn("Fail to write admin response")
+	}
+}
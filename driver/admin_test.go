@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/internal/fakehw"
+)
+
+func TestStoreNetworkPfs(t *testing.T) {
+	hw := fakehw.New()
+	pf0 := hw.AddPf("ens1f0", 4, 4)
+	pf1 := hw.AddPf("ens1f1", 4, 4)
+	hw.AddPf("ens2f0", 4, 4)
+	store := newFileStore(t.TempDir())
+	err := store.Update(func(tx StoreTx) error {
+		err := tx.PutNetwork(testNetworkID, &DbNetworkInfo{Mode: networkModeSRIOV, Netdev: "ens1f*"})
+		if err != nil {
+			return err
+		}
+		// stored without its PF, as by older versions
+		err = tx.PutEndpoint(testNetworkID, "ep1", &DbEndpointInfo{VfIndex: 1, VfPciAddress: pf1.Vfs[1].PciAddress})
+		if err != nil {
+			return err
+		}
+		return tx.PutEndpoint(testNetworkID, "ep0", &DbEndpointInfo{PfNetdev: "ens1f0", VfPciAddress: pf0.Vfs[0].PciAddress})
+	})
+	if err != nil {
+		t.Fatalf("writing state: %v", err)
+	}
+
+	networks, err := StoreNetworks(hw, store)
+	if err != nil {
+		t.Fatalf("StoreNetworks: %v", err)
+	}
+	nw := networks[0]
+	if len(nw.Pfs) != 2 || nw.Pfs[0] != "ens1f0" || nw.Pfs[1] != "ens1f1" {
+		t.Errorf("network PFs are %v, expected ens1f0 and ens1f1", nw.Pfs)
+	}
+	if nw.Endpoints[0].Pf != "ens1f0" || nw.Endpoints[1].Pf != "ens1f1" {
+		t.Errorf("endpoint PFs are %s and %s", nw.Endpoints[0].Pf, nw.Endpoints[1].Pf)
+	}
+
+	for name, refCount := range map[string]int{"ens1f0": 1, "ens1f1": 1, "ens2f0": 0} {
+		dev, err := StorePfDevice(hw, store, name)
+		if err != nil {
+			t.Fatalf("StorePfDevice %s: %v", name, err)
+		}
+		if dev.RefCount != refCount {
+			t.Errorf("%s used by %d networks, expected %d", name, dev.RefCount, refCount)
+		}
+	}
+	dev, _ := StorePfDevice(hw, store, "ens1f1")
+	if !dev.Vfs[1].Allocated || dev.Vfs[1].EndpointID != "ep1" || dev.FreeVfs != 3 {
+		t.Errorf("VF 1 of ens1f1 is %+v, %d VFs free", dev.Vfs[1], dev.FreeVfs)
+	}
+}
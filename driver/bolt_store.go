@@ -0,0 +1,312 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltStoreFile = "state.db"
+
+	// directory networks imported from the file layout are moved to
+	importedDir = ".imported"
+
+	// time to wait for another process holding the database
+	boltOpenTimeout = 10 * time.Second
+)
+
+/* Database layout
+networks/
+	nw-1/
+		config -> network record
+		endpoints/
+			ep-1 -> endpoint record
+			ep-2 -> endpoint record
+	nw-2/
+vfs/
+	0000:03:00.2 -> VF record
+meta/
+	imported -> time the file layout was imported
+*/
+
+var (
+	boltNetworksBucket  = []byte("networks")
+	boltEndpointsBucket = []byte("endpoints")
+	boltConfigKey       = []byte("config")
+	boltVfsBucket       = []byte("vfs")
+	boltMetaBucket      = []byte("meta")
+	boltImportedKey     = []byte("imported")
+)
+
+// boltStore is the Store keeping networks and endpoints in an embedded
+// bbolt database, where a transaction is applied as a whole or not at all.
+type boltStore struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// openBoltStore opens the database in a state directory. Networks kept in
+// the file layout in the directory are imported into it.
+func openBoltStore(dir string) (Store, error) {
+	err := mkdirp(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, boltStoreFile), 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{db: db}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltNetworksBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltVfsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltMetaBucket)
+		return err
+	})
+	if err == nil {
+		err = importFileStore(s, dir)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openBoltStoreReadOnly opens the database in a state directory for
+// reading. Buckets missing from it are read as empty.
+func openBoltStoreReadOnly(dir string) (Store, error) {
+	db, err := bolt.Open(filepath.Join(dir, boltStoreFile), 0600,
+		&bolt.Options{ReadOnly: true, Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// importFileStore imports the networks and VFs kept in the file layout in
+// a directory into the database, once. The imported directories are moved
+// aside. A database without the import mark next to an .imported directory
+// was imported before the mark existed, so its remaining VF records are
+// only moved aside.
+func importFileStore(s *boltStore, dir string) error {
+	imported := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(boltMetaBucket).Get(boltImportedKey) != nil
+		return nil
+	})
+	if err != nil || imported {
+		return err
+	}
+
+	var nids []string
+	_, err = os.Stat(filepath.Join(dir, importedDir))
+	if os.IsNotExist(err) {
+		nids, err = ImportStore(s, newFileStore(dir))
+	}
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltImportedKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = mkdirp(filepath.Join(dir, importedDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range append(nids, vfsDir) {
+		source := filepath.Join(dir, name)
+		if _, err = os.Stat(source); os.IsNotExist(err) {
+			continue
+		}
+		target := filepath.Join(dir, importedDir, name)
+		os.RemoveAll(target)
+		err = os.Rename(source, target)
+		if err != nil {
+			return err
+		}
+	}
+	if len(nids) > 0 {
+		logger.Infof("Imported %d networks from %s, kept in %s", len(nids), dir, importedDir)
+	}
+	return nil
+}
+
+func (s *boltStore) View(fn func(tx StoreTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (tx *boltTx) Networks() (map[string]*DbNetworkInfo, error) {
+	nwList := make(map[string]*DbNetworkInfo)
+
+	networks := tx.tx.Bucket(boltNetworksBucket)
+	if networks == nil {
+		return nwList, nil
+	}
+	err := networks.ForEach(func(key []byte, value []byte) error {
+		nwBucket := networks.Bucket(key)
+		if nwBucket == nil {
+			return nil
+		}
+		rawData := nwBucket.Get(boltConfigKey)
+		if rawData == nil {
+			return nil
+		}
+
+		nw := DbNetworkInfo{}
+		err := decodeRecord(rawData, nwMigrations, &nw)
+		if err != nil {
+			logger.WithError(err).WithField(logFieldNetwork, string(key)).Warn("Skipping unreadable network")
+			return nil
+		}
+		nwList[string(key)] = &nw
+		return nil
+	})
+	return nwList, err
+}
+
+func (tx *boltTx) PutNetwork(nid string, nw *DbNetworkInfo) error {
+	nw.Version = nwSchemaVersion
+	rawData, err := json.Marshal(nw)
+	if err != nil {
+		return err
+	}
+
+	nwBucket, err := tx.tx.Bucket(boltNetworksBucket).CreateBucketIfNotExists([]byte(nid))
+	if err != nil {
+		return err
+	}
+	return nwBucket.Put(boltConfigKey, rawData)
+}
+
+func (tx *boltTx) DeleteNetwork(nid string) error {
+	err := tx.tx.Bucket(boltNetworksBucket).DeleteBucket([]byte(nid))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+func (tx *boltTx) endpointsBucket(nid string) *bolt.Bucket {
+	networks := tx.tx.Bucket(boltNetworksBucket)
+	if networks == nil {
+		return nil
+	}
+	nwBucket := networks.Bucket([]byte(nid))
+	if nwBucket == nil {
+		return nil
+	}
+	return nwBucket.Bucket(boltEndpointsBucket)
+}
+
+func (tx *boltTx) Endpoints(nid string) (map[string]*DbEndpointInfo, error) {
+	epList := make(map[string]*DbEndpointInfo)
+
+	endpoints := tx.endpointsBucket(nid)
+	if endpoints == nil {
+		return epList, nil
+	}
+	err := endpoints.ForEach(func(key []byte, rawData []byte) error {
+		ep := DbEndpointInfo{}
+		err := decodeRecord(rawData, epMigrations, &ep)
+		if err != nil {
+			logger.WithError(err).WithFields(logrus.Fields{logFieldNetwork: nid, logFieldEndpoint: string(key)}).Warn("Skipping unreadable endpoint")
+			return nil
+		}
+		epList[string(key)] = &ep
+		return nil
+	})
+	return epList, err
+}
+
+func (tx *boltTx) PutEndpoint(nid string, eid string, ep *DbEndpointInfo) error {
+	ep.Version = epSchemaVersion
+	rawData, err := json.Marshal(ep)
+	if err != nil {
+		return err
+	}
+
+	nwBucket := tx.tx.Bucket(boltNetworksBucket).Bucket([]byte(nid))
+	if nwBucket == nil {
+		return fmt.Errorf("network %s is not stored", nid)
+	}
+	endpoints, err := nwBucket.CreateBucketIfNotExists(boltEndpointsBucket)
+	if err != nil {
+		return err
+	}
+	return endpoints.Put([]byte(eid), rawData)
+}
+
+func (tx *boltTx) DeleteEndpoint(nid string, eid string) error {
+	endpoints := tx.endpointsBucket(nid)
+	if endpoints == nil {
+		return nil
+	}
+	return endpoints.Delete([]byte(eid))
+}
+
+func (tx *boltTx) Vfs() (map[string]*DbVfInfo, error) {
+	vfList := make(map[string]*DbVfInfo)
+
+	vfs := tx.tx.Bucket(boltVfsBucket)
+	if vfs == nil {
+		return vfList, nil
+	}
+	err := vfs.ForEach(func(key []byte, rawData []byte) error {
+		vf := DbVfInfo{}
+		err := decodeVfRecord(rawData, &vf)
+		if err != nil {
+			logger.WithError(err).WithField("pci", string(key)).Warn("Skipping unreadable VF")
+			return nil
+		}
+		vfList[string(key)] = &vf
+		return nil
+	})
+	return vfList, err
+}
+
+func (tx *boltTx) PutVf(pciAddr string, vf *DbVfInfo) error {
+	vf.Version = vfSchemaVersion
+	rawData, err := json.Marshal(vf)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Bucket(boltVfsBucket).Put([]byte(pciAddr), rawData)
+}
+
+func (tx *boltTx) DeleteVf(pciAddr string) error {
+	return tx.tx.Bucket(boltVfsBucket).Delete([]byte(pciAddr))
+}
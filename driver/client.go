@@ -2,41 +2,46 @@ package driver
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 )
 
-func getRightClientApiVersion() (string, error) {
-	// Start with the lowest API to query which version is supported.
-	lowestCli, err3 := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.24"))
-	if err3 != nil {
-		fmt.Println("Fail to create client: ", err3)
-		return "", err3
-	}
-	allVersions, err2 := lowestCli.ServerVersion(context.Background())
-	if err2 != nil {
-		fmt.Println("Error to get server version: ", err2)
-		return "", err2
-	}
-	return allVersions.APIVersion, nil
-}
+var (
+	dockerClientLock sync.Mutex
+	dockerClient     *client.Client
+)
 
+// getRightClient returns the client shared by all calls to the Docker API,
+// creating it with the API version of the daemon on first use.
 func getRightClient() (*client.Client, error) {
-	var clientVersion string
+	dockerClientLock.Lock()
+	defer dockerClientLock.Unlock()
 
-	desiredVersion, err := getRightClientApiVersion()
+	if dockerClient != nil {
+		return dockerClient, nil
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
-		clientVersion = "unknown"
-	} else {
-		clientVersion = desiredVersion
+		logger.WithError(err).Debug("Fail to create client")
+		return nil, err
 	}
-	cli, err2 := client.NewClientWithOpts(client.FromEnv, client.WithVersion(clientVersion))
-	if err2 == nil {
-		return cli, nil
+	ping, err := cli.Ping(context.Background())
+	if err != nil {
+		logger.WithError(err).Debug("Fail to ping Docker")
+		cli.Close()
+		return nil, err
 	}
-	return nil, err
+	cli.NegotiateAPIVersionPing(ping)
+	dockerClient = cli
+	return cli, nil
 }
 
 func GetNetworkList() (map[string]types.NetworkResource, error) {
@@ -55,3 +60,138 @@ func GetNetworkList() (map[string]types.NetworkResource, error) {
 	}
 	return res, nil
 }
+
+// GetPendingContainerCpuset returns the cpuset of the container which is
+// being connected to a network, or an empty string when there is none
+// or several containers are being connected.
+//
+// The container is still locked by the daemon while its endpoint is
+// created, so ContainerInspect would block until the plugin call times
+// out. The lock free container list identifies the container, and its
+// host config is read from the daemon root directory instead. Only
+// containers which are created or restarted are told apart from stopped
+// ones, not those started again with docker start.
+func GetPendingContainerCpuset(networkID string) (string, error) {
+	cli, err := getRightClient()
+	if err != nil {
+		return "", err
+	}
+
+	args := filters.NewArgs(
+		filters.Arg("network", networkID),
+		filters.Arg("status", "created"),
+		filters.Arg("status", "restarting"),
+	)
+	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     true,
+		Filters: args,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var pending []string
+	for _, c := range containers {
+		if c.NetworkSettings == nil {
+			continue
+		}
+		for _, epSettings := range c.NetworkSettings.Networks {
+			if epSettings.NetworkID == networkID && epSettings.EndpointID == "" {
+				pending = append(pending, c.ID)
+			}
+		}
+	}
+	if len(pending) != 1 {
+		return "", nil
+	}
+
+	rootDir, err := getDockerRootDir(cli)
+	if err != nil {
+		return "", err
+	}
+	rawData, err := ioutil.ReadFile(filepath.Join(rootDir, "containers", pending[0], "hostconfig.json"))
+	if err != nil {
+		return "", err
+	}
+	hostConfig := container.HostConfig{}
+	err = json.Unmarshal(rawData, &hostConfig)
+	if err != nil {
+		return "", err
+	}
+	return hostConfig.CpusetCpus, nil
+}
+
+var (
+	dockerRootDirLock sync.Mutex
+	dockerRootDir     string
+)
+
+// getDockerRootDir returns the root directory of the daemon, which is
+// asked only once.
+func getDockerRootDir(cli *client.Client) (string, error) {
+	dockerRootDirLock.Lock()
+	defer dockerRootDirLock.Unlock()
+
+	if dockerRootDir != "" {
+		return dockerRootDir, nil
+	}
+	info, err := cli.Info(context.Background())
+	if err != nil {
+		return "", err
+	}
+	dockerRootDir = info.DockerRootDir
+	return dockerRootDir, nil
+}
+
+// GetNetworkEndpoints returns the IDs of the endpoints Docker has on a
+// network.
+func GetNetworkEndpoints(networkID string) (map[string]bool, error) {
+	cli, err := getRightClient()
+	if err != nil {
+		return nil, err
+	}
+	nw, err := cli.NetworkInspect(context.Background(), networkID, types.NetworkInspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]bool)
+	for _, ep := range nw.Containers {
+		res[ep.EndpointID] = true
+	}
+	return res, nil
+}
+
+// WatchNetworkEvents calls notify for each network event of Docker until
+// the context is done or the event stream fails.
+func WatchNetworkEvents(ctx context.Context, notify func(events.Message)) error {
+	cli, err := getRightClient()
+	if err != nil {
+		return err
+	}
+
+	args := filters.NewArgs(filters.Arg("type", events.NetworkEventType))
+	messages, errs := cli.Events(ctx, types.EventsOptions{Filters: args})
+	for {
+		select {
+		case msg := <-messages:
+			notify(msg)
+		case err = <-errs:
+			return err
+		}
+	}
+}
+
+// PingDocker checks that the Docker API is reachable, returning the API
+// version of the daemon.
+func PingDocker() (string, error) {
+	cli, err := getRightClient()
+	if err != nil {
+		return "", err
+	}
+	ping, err := cli.Ping(context.Background())
+	if err != nil {
+		return "", err
+	}
+	return ping.APIVersion, nil
+}
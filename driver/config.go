@@ -0,0 +1,179 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of a plugin instance. Several instances can
+// run on a host, each with its own socket and state directory.
+type Config struct {
+	// plugin name, served in the plugin directory of Docker, or socket path
+	Socket string `yaml:"socket"`
+	// directory networks and endpoints are persisted in
+	StateDir string `yaml:"state_dir"`
+	// file or bolt, networks kept in files are imported into bolt
+	StateBackend string `yaml:"state_backend"`
+	// socket of the admin API, by default derived from the plugin socket
+	AdminSocket string `yaml:"admin_socket"`
+	// socket of the control API releasing VFs, only accessible to the root
+	// user, by default derived from the plugin socket
+	ControlSocket string `yaml:"control_socket"`
+	// TCP address Prometheus metrics are served on, such as :9310, none
+	// when empty. They are served on the admin socket too.
+	MetricsAddress string `yaml:"metrics_address"`
+	// debug, info, warn or error, debug logs every request
+	LogLevel string `yaml:"log_level"`
+	// text for logfmt, or json
+	LogFormat         string        `yaml:"log_format"`
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+	// interval Docker is retried at while it is unreachable
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	// options of networks created without them, such as prefix or mode
+	NetworkDefaults map[string]string `yaml:"network_defaults"`
+}
+
+// DefaultConfig returns the configuration of a plugin instance started
+// without a config file or flags.
+func DefaultConfig() *Config {
+	return &Config{
+		Socket:            "sriov",
+		StateDir:          defaultPersistConfigPath,
+		StateBackend:      stateBackendFile,
+		LogLevel:          logLevelInfo,
+		LogFormat:         logFormatText,
+		ReconcileInterval: defaultReconcileInterval,
+		RetryInterval:     defaultDockerRetryInterval,
+		NetworkDefaults:   map[string]string{},
+	}
+}
+
+// LoadConfig reads a YAML or JSON config file. Settings missing from it
+// keep their default.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+
+	rawData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(rawData))
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Fail to parse config file %s: %v", path, err)
+	}
+	if config.NetworkDefaults == nil {
+		config.NetworkDefaults = map[string]string{}
+	}
+	return config, nil
+}
+
+// networkDefaultOptions are the network options a config can give a
+// default for. PF selectors are given so an instance can default to its
+// own PFs, one of them at most.
+var networkDefaultOptions = map[string]bool{
+	networkDevice:     true,
+	networkMode:       true,
+	sriovVlan:         true,
+	networkPrivileged: true,
+	ethPrefix:         true,
+	roceHopLimit:      true,
+	maxTxRate:         true,
+	minTxRate:         true,
+	sriovNumVfs:       true,
+	vfDriver:          true,
+	allocStrategy:     true,
+	pfPciAddress:      true,
+	pfMacAddress:      true,
+}
+
+// Validate checks the settings of a config.
+func (config *Config) Validate() error {
+	if config.Socket == "" {
+		return fmt.Errorf("socket must be given")
+	}
+	if config.StateDir == "" {
+		return fmt.Errorf("state directory must be given")
+	}
+	if config.StateBackend != stateBackendFile && config.StateBackend != stateBackendBolt {
+		return fmt.Errorf("valid state backends are: %s and %s", stateBackendFile, stateBackendBolt)
+	}
+	if config.ControlSocketPath() == config.AdminSocketPath() {
+		return fmt.Errorf("control socket must differ from the admin socket")
+	}
+	if config.MetricsAddress != "" {
+		_, _, err := net.SplitHostPort(config.MetricsAddress)
+		if err != nil {
+			return fmt.Errorf("invalid metrics address: %v", err)
+		}
+	}
+	if _, ok := logLevels[config.LogLevel]; !ok {
+		return fmt.Errorf("valid log levels are: %s, %s, %s and %s",
+			logLevelDebug, logLevelInfo, logLevelWarn, logLevelError)
+	}
+	if config.LogFormat != logFormatText && config.LogFormat != logFormatJSON {
+		return fmt.Errorf("valid log formats are: %s and %s", logFormatText, logFormatJSON)
+	}
+	if config.ReconcileInterval <= 0 {
+		return fmt.Errorf("reconcile interval must be positive")
+	}
+	if config.RetryInterval <= 0 {
+		return fmt.Errorf("retry interval must be positive")
+	}
+	for key, value := range config.NetworkDefaults {
+		if !networkDefaultOptions[key] {
+			return fmt.Errorf("unknown network option %s", key)
+		}
+		if key == networkMode && value != networkModePT && value != networkModeSRIOV {
+			return fmt.Errorf("valid modes are: passthrough and sriov")
+		}
+	}
+	if len(pfSelectors(config.NetworkDefaults)) > 1 {
+		return fmt.Errorf("only one of %s, %s and %s can have a default", networkDevice, pfPciAddress, pfMacAddress)
+	}
+	return nil
+}
+
+// Reload applies the settings of a config which can change while the
+// plugin runs. The sockets, metrics address and state only change on
+// restart.
+func (d *driver) Reload(config *Config) {
+	d.Lock()
+	defer d.Unlock()
+
+	if config.Socket != d.config.Socket || config.AdminSocket != d.config.AdminSocket ||
+		config.ControlSocket != d.config.ControlSocket || config.MetricsAddress != d.config.MetricsAddress ||
+		config.StateDir != d.config.StateDir || config.StateBackend != d.config.StateBackend {
+		logger.Warn("Socket and state changes take effect on restart")
+	}
+	SetLogLevel(config.LogLevel)
+	SetLogFormat(config.LogFormat)
+
+	socket, adminSocket, controlSocket := d.config.Socket, d.config.AdminSocket, d.config.ControlSocket
+	metricsAddress := d.config.MetricsAddress
+	stateDir, stateBackend := d.config.StateDir, d.config.StateBackend
+	d.config = *config
+	d.config.Socket = socket
+	d.config.AdminSocket = adminSocket
+	d.config.ControlSocket = controlSocket
+	d.config.MetricsAddress = metricsAddress
+	d.config.StateDir = stateDir
+	d.config.StateBackend = stateBackend
+	logger.WithField("config", fmt.Sprintf("%+v", d.config)).Info("Reloaded config")
+}
+
+// reconcileIntervals returns the intervals reconciling is done and retried
+// at.
+func (d *driver) reconcileIntervals() (time.Duration, time.Duration) {
+	d.RLock()
+	defer d.RUnlock()
+	return d.config.ReconcileInterval, d.config.RetryInterval
+}
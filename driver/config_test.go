@@ -0,0 +1,49 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/internal/fakehw"
+)
+
+func TestNetworkDefaultPfSelector(t *testing.T) {
+	defaults := map[string]string{networkDevice: "ens1f0", ethPrefix: "ib"}
+	hw := fakehw.New()
+	hw.AddPf("ens1f0", 8, 0)
+	hw.AddPf("ens1f1", 8, 0)
+
+	for _, given := range []map[string]interface{}{
+		{pfPciAddress: hw.Pfs["ens1f1"].PciAddress},
+		{pfMacAddress: hw.Pfs["ens1f1"].MacAddress},
+	} {
+		options, err := parseNetworkGenericOptions(testLog(t), given, defaults)
+		if err != nil {
+			t.Fatalf("options %v: %v", given, err)
+		}
+		if options[networkDevice] != "" || options[ethPrefix] != "ib" {
+			t.Errorf("options %v defaulted to %v", given, options)
+		}
+		err = resolveNetworkDevice(testLog(t), hw, options)
+		if err != nil || options[networkDevice] != "ens1f1" {
+			t.Errorf("options %v resolved to %s: %v", given, options[networkDevice], err)
+		}
+	}
+
+	options, err := parseNetworkGenericOptions(testLog(t), map[string]interface{}{}, defaults)
+	if err != nil || options[networkDevice] != "ens1f0" {
+		t.Errorf("default netdevice not applied: %v, %v", options, err)
+	}
+}
+
+func TestValidateNetworkDefaults(t *testing.T) {
+	for _, defaults := range []map[string]string{
+		{networkDevice: "ens1f0", pfPciAddress: "0000:01:00.0"},
+		{numaNode: "1"},
+	} {
+		config := DefaultConfig()
+		config.NetworkDefaults = defaults
+		if config.Validate() == nil {
+			t.Errorf("network defaults %v accepted", defaults)
+		}
+	}
+}
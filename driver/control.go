@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-connections/sockets"
+	"github.com/k8snetworkplumbingwg/sriovnet"
+)
+
+// ControlSocketPath returns the socket the control API of a plugin
+// instance is served on.
+func (config *Config) ControlSocketPath() string {
+	if config.ControlSocket != "" {
+		return config.ControlSocket
+	}
+	if filepath.IsAbs(config.Socket) {
+		return strings.TrimSuffix(config.Socket, ".sock") + "-control.sock"
+	}
+	return filepath.Join(adminSockDir, config.Socket+"-control.sock")
+}
+
+// ControlServer serves the requests changing the state of a driver, kept
+// apart from the read only admin API:
+//
+//	POST /pfs/<name>/vfs/<index>/release
+//	                                frees a VF no endpoint holds
+type ControlServer struct {
+	d      *driver
+	socket string
+	server *http.Server
+}
+
+func NewControlServer(d *driver, socket string) *ControlServer {
+	s := &ControlServer{
+		d:      d,
+		socket: socket,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pfs/", s.handleVf)
+	s.server = &http.Server{Handler: mux}
+	return s
+}
+
+// Serve serves the control API until the server is closed. The socket is
+// only accessible to the root user, not to the root group.
+func (s *ControlServer) Serve() error {
+	err := os.MkdirAll(filepath.Dir(s.socket), 0755)
+	if err != nil {
+		return err
+	}
+	l, err := sockets.NewUnixSocket(s.socket, 0)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(s.socket, 0600)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	err = s.server.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops serving and removes the socket.
+func (s *ControlServer) Close() error {
+	err := s.server.Close()
+	os.Remove(s.socket)
+	return err
+}
+
+// handleVf handles POST /pfs/<name>/vfs/<index>/release, for recovering
+// VFs manually.
+func (s *ControlServer) handleVf(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(itemName(r, "/pfs"), "/")
+	if len(path) != 4 || path[1] != "vfs" || path[3] != "release" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	index, err := strconv.Atoi(path[2])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid VF index %s", path[2]), http.StatusBadRequest)
+		return
+	}
+
+	err = s.d.releaseStuckVf(path[0], index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// releaseStuckVf returns a VF which is allocated without an endpoint
+// holding it, such as a quarantined one, to the free pool once its
+// configuration is reset. The driver lock is held for writing, so no
+// endpoint is being created with the VF meanwhile.
+func (d *driver) releaseStuckVf(pfNetdevName string, index int) error {
+	d.Lock()
+	defer d.Unlock()
+
+	dev := d.getPfDevice(pfNetdevName)
+	if dev == nil {
+		return fmt.Errorf("PF %s is not used by any sriov network", pfNetdevName)
+	}
+
+	for nid, nw := range d.networks {
+		genNw := nw.getGenNw()
+		genNw.lock.Lock()
+		for id, endpoint := range genNw.ndevEndpoints {
+			if endpoint.pfName == pfNetdevName && endpoint.vfObj != nil && endpoint.vfObj.Index == index {
+				genNw.lock.Unlock()
+				return fmt.Errorf("VF %d of %s is held by endpoint %s of network %s", index, pfNetdevName, id, nid)
+			}
+		}
+		genNw.lock.Unlock()
+	}
+
+	var vfObj *sriovnet.VfObj
+	dev.lock.Lock()
+	for _, vf := range dev.pfHandle.List {
+		if vf.Index == index {
+			vfObj = vf
+		}
+	}
+	allocated := vfObj != nil && vfObj.Allocated
+	dev.lock.Unlock()
+	if vfObj == nil {
+		return fmt.Errorf("VF %d not found on %s", index, pfNetdevName)
+	}
+	if !allocated {
+		return fmt.Errorf("VF %d of %s is not allocated", index, pfNetdevName)
+	}
+
+	log := vfLogger(requestLogger("ReleaseVf", "", ""), pfNetdevName, index)
+	err := d.resetStuckVf(log, dev, vfObj)
+	if err != nil {
+		return fmt.Errorf("Fail to reset VF %d of %s: %v", index, pfNetdevName, err)
+	}
+	log.Info("Released VF on request")
+	return nil
+}
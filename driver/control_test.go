@@ -0,0 +1,41 @@
+package driver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/internal/fakehw"
+)
+
+func TestReleaseVfOnlyThroughControl(t *testing.T) {
+	hw := fakehw.New()
+	pf := hw.AddPf("ens1f0", 8, 4)
+	d := startTestDriver(t, hw, testConfig(t))
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	pf.Vfs[0].FailReset = errDeviceBusy
+	runLifecycle(t, d, testNetworkID, testEndpointID, nil)
+	pf.Vfs[0].FailReset = nil
+
+	admin := NewAdminServer(d, "")
+	resp := httptest.NewRecorder()
+	admin.server.Handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/pfs/ens1f0/vfs/0/release", nil))
+	if resp.Code/100 == 2 || d.getPfDevice("ens1f0").freeVfCount() != 3 {
+		t.Fatalf("admin API released a VF, status %d", resp.Code)
+	}
+
+	control := NewControlServer(d, "")
+	resp = httptest.NewRecorder()
+	control.server.Handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/pfs/ens1f0/vfs/0/release", nil))
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("control API release returned %d: %s", resp.Code, resp.Body)
+	}
+	if d.getPfDevice("ens1f0").freeVfCount() != 4 {
+		t.Errorf("%d VFs free after release, expected 4", d.getPfDevice("ens1f0").freeVfCount())
+	}
+}
@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DoctorCheck is the outcome of a check of the host for the plugin.
+type DoctorCheck struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// Doctor checks that the Docker API is reachable, and that each PF exists,
+// has SR-IOV enabled and is mapped to an RDMA device. PFs are netdevices
+// or glob patterns like those of the netdevice option.
+func Doctor(hw Hardware, netdevices []string) []DoctorCheck {
+	var checks []DoctorCheck
+
+	check := DoctorCheck{Name: "docker API reachable"}
+	apiVersion, err := PingDocker()
+	if err == nil {
+		check.Detail = "API version " + apiVersion
+	} else {
+		check.Err = err
+	}
+	checks = append(checks, check)
+
+	for _, netdevice := range netdevices {
+		pfNames, err := resolvePfNames(hw, netdevice)
+		if err != nil {
+			checks = append(checks, DoctorCheck{Name: "PF " + netdevice + " exists", Err: err})
+			continue
+		}
+		for _, pfName := range pfNames {
+			checks = append(checks, doctorPf(hw, pfName)...)
+		}
+	}
+	return checks
+}
+
+func doctorPf(hw Hardware, pfName string) []DoctorCheck {
+	var checks []DoctorCheck
+
+	check := DoctorCheck{Name: "PF " + pfName + " exists"}
+	if !hw.NetdevExists(pfName) {
+		check.Err = fmt.Errorf("netdevice %s not found", pfName)
+		return append(checks, check)
+	}
+	// the PCI address is looked up only for PCI devices, sriovnet does
+	// not return for virtual netdevices
+	totalVfs, err := hw.GetTotalVfCount(pfName)
+	if err == nil {
+		pciAddr, err := hw.GetPciAddress(pfName)
+		if err == nil {
+			check.Detail = "PCI address " + pciAddr
+		}
+	}
+	checks = append(checks, check)
+
+	check = DoctorCheck{Name: "PF " + pfName + " has SR-IOV enabled"}
+	switch {
+	case err != nil:
+		check.Err = err
+	case !hw.IsSriovEnabled(pfName):
+		check.Err = fmt.Errorf("no VFs enabled of %d, create networks with numvfs or enable them with sriov_numvfs", totalVfs)
+	default:
+		handle, err := hw.GetPfHandle(pfName)
+		if err != nil {
+			check.Err = err
+		} else {
+			check.Detail = fmt.Sprintf("%d of %d VFs enabled", len(handle.List), totalVfs)
+		}
+	}
+	checks = append(checks, check)
+
+	check = DoctorCheck{Name: "PF " + pfName + " has an RDMA device"}
+	rdmaDev, err := hw.GetRdmaDevice(pfName)
+	if err != nil {
+		check.Err = err
+	} else {
+		check.Detail = rdmaDev
+	}
+	return append(checks, check)
+}
+
+// DoctorFailed reports whether any of the checks failed.
+func DoctorFailed(checks []DoctorCheck) bool {
+	for _, check := range checks {
+		if check.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (check DoctorCheck) String() string {
+	if check.Err != nil {
+		return fmt.Sprintf("FAIL %s: %v", check.Name, check.Err)
+	}
+	if check.Detail == "" {
+		return "OK   " + check.Name
+	}
+	return fmt.Sprintf("OK   %s: %s", check.Name, strings.TrimSpace(check.Detail))
+}
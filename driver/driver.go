@@ -2,12 +2,10 @@ package driver
 
 import (
 	"fmt"
-	"log"
 	"net"
-	"os"
-	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +13,7 @@ import (
 	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/options"
 	"github.com/k8snetworkplumbingwg/sriovnet"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -28,6 +27,14 @@ const (
 	networkPrivileged = "privileged"
 	ethPrefix         = "prefix"
 	roceHopLimit      = "rocehoplimit"
+	maxTxRate         = "max_tx_rate"
+	minTxRate         = "min_tx_rate"
+	sriovNumVfs       = "numvfs"
+	vfDriver          = "vf_driver"
+	allocStrategy     = "alloc_strategy"
+	numaNode          = "numa_node"
+	pfPciAddress      = "pci"    // PF selected by PCI address -o pci
+	pfMacAddress      = "pf_mac" // PF selected by MAC address -o pf_mac
 )
 
 type ptEndpoint struct {
@@ -37,23 +44,44 @@ type ptEndpoint struct {
 	/* value */
 	HardwareAddr string
 	devName      string
+	pfName       string
 	mtu          int
 	Address      string
 	sandboxKey   string
 	vfName       string
 	vfObj        *sriovnet.VfObj
+	minTxRate    int
+	maxTxRate    int
+
+	// endpoints are only reconciled with Docker some time after this,
+	// zero for endpoints restored at startup
+	created time.Time
+
+	// VF settings restored when the VF is released
+	vfBaseMac    string
+	baseHopLimit uint8
+	hopLimitSet  bool
+	origVfDriver string
+	vfioBound    bool
+
+	iommuGroup string
 }
 
 type genericNetwork struct {
 	id            string
-	lock          sync.Mutex
+	lock          sync.Mutex // protects ndevEndpoints and their endpoints
 	IPv4Data      *network.IPAMData
+	IPv6Data      *network.IPAMData
 	ndevEndpoints map[string]*ptEndpoint
 	driver        *driver // The network's driver
 	mode          string  // SRIOV or Passthough
 	ethPrefix     string
 
 	ndevName string
+
+	// networks are only reconciled with Docker some time after this,
+	// zero for networks restored at startup
+	created time.Time
 }
 
 type ptNetwork struct {
@@ -61,13 +89,16 @@ type ptNetwork struct {
 }
 
 type NwIface interface {
-	CreateNetwork(d *driver, genNw *genericNetwork,
+	CreateNetwork(log *logrus.Entry, d *driver, genNw *genericNetwork,
 		nid string, options map[string]string,
-		ipv4Data *network.IPAMData) error
-	DeleteNetwork(d *driver, req *network.DeleteNetworkRequest)
+		ipv4Data *network.IPAMData, ipv6Data *network.IPAMData) error
+	DeleteNetwork(log *logrus.Entry, d *driver, req *network.DeleteNetworkRequest)
 
-	CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error)
-	DeleteEndpoint(endpoint *ptEndpoint)
+	CreateEndpoint(log *logrus.Entry, r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error)
+	// DeleteEndpoint returns why the VF of the endpoint was quarantined
+	// instead of freed, if it was.
+	DeleteEndpoint(log *logrus.Entry, endpoint *ptEndpoint) error
+	RestoreEndpoint(log *logrus.Entry, id string, info *DbEndpointInfo) error
 
 	getGenNw() *genericNetwork
 }
@@ -75,17 +106,45 @@ type NwIface interface {
 type driver struct {
 	// below map maps a network id to NwInterface object
 	networks map[string]NwIface
-	sync.Mutex
+	// held for writing while networks are created or deleted, and for
+	// reading while endpoints are, so endpoints are handled in parallel
+	sync.RWMutex
+
+	// netdevice to sriovstate map of the PFs used by sriov networks
+	pfDevices map[string]*pfDevice
+
+	// stored VFs of endpoints which were not restored, such as those of
+	// networks written by a newer plugin, by PCI address. They stay
+	// allocated until released or their network is deleted.
+	reservedVfs map[string]*DbVfInfo
+
+	// access to the PFs and VFs of the host
+	hw Hardware
+
+	// persisted networks and endpoints
+	store Store
+
+	// networks and endpoints Docker has
+	docker dockerLookup
+
+	reconcileTrigger chan struct{}
+
+	// settings of the plugin instance, changed on reload
+	config Config
+
+	metrics *metrics
 }
 
 func createGenNw(nid string, ndevName string,
-	networkMode string, ethPrefix string, ipv4Data *network.IPAMData) *genericNetwork {
+	networkMode string, ethPrefix string,
+	ipv4Data *network.IPAMData, ipv6Data *network.IPAMData) *genericNetwork {
 
 	genNw := genericNetwork{}
 	ndevs := map[string]*ptEndpoint{}
 	genNw.id = nid
 	genNw.mode = networkMode
 	genNw.IPv4Data = ipv4Data
+	genNw.IPv6Data = ipv6Data
 	genNw.ndevEndpoints = ndevs
 	genNw.ndevName = ndevName
 	genNw.ethPrefix = ethPrefix
@@ -93,12 +152,13 @@ func createGenNw(nid string, ndevName string,
 	return &genNw
 }
 
-func (d *driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
+func (d *driver) GetCapabilities(log *logrus.Entry) (*network.CapabilitiesResponse, error) {
 	return &network.CapabilitiesResponse{Scope: network.LocalScope}, nil
 }
 
-// parseNetworkGenericOptions parses generic driver docker network options
-func parseNetworkGenericOptions(data interface{}) (map[string]string, error) {
+// parseNetworkGenericOptions parses generic driver docker network options,
+// filling in the defaults of the plugin instance for options not given
+func parseNetworkGenericOptions(log *logrus.Entry, data interface{}, defaults map[string]string) (map[string]string, error) {
 	var err error
 
 	options := make(map[string]string)
@@ -108,9 +168,18 @@ func parseNetworkGenericOptions(data interface{}) (map[string]string, error) {
 		for key, value := range opt {
 			options[key] = fmt.Sprintf("%s", value)
 		}
-		log.Printf("parseNetworkGenericOptions %v\n", options)
+		log.WithField("options", options).Debug("Parsed network options")
 	default:
-		log.Printf("unrecognized network config format: %v\n", reflect.TypeOf(opt))
+		log.WithField("type", reflect.TypeOf(opt)).Warn("Unrecognized network config format")
+	}
+
+	// the PF selectors are defaulted as one, so a default netdevice does
+	// not clash with a pci or pf_mac given
+	selectorGiven := hasPfSelector(options)
+	for key, value := range defaults {
+		if options[key] == "" && !(selectorGiven && pfSelectorKeys[key]) {
+			options[key] = value
+		}
 	}
 
 	if options[networkMode] == "" {
@@ -122,11 +191,11 @@ func parseNetworkGenericOptions(data interface{}) (map[string]string, error) {
 			return options, fmt.Errorf("valid modes are: passthrough and sriov")
 		}
 	}
-	if options[networkDevice] == "" {
+	if options[networkDevice] == "" && options[pfPciAddress] == "" && options[pfMacAddress] == "" {
 		if options[networkMode] == networkModeSRIOV {
-			return options, fmt.Errorf("sriov mode requires netdevice")
+			return options, fmt.Errorf("sriov mode requires netdevice, pci or pf_mac")
 		} else {
-			return options, fmt.Errorf("passthrough mode requires netdevice")
+			return options, fmt.Errorf("passthrough mode requires netdevice, pci or pf_mac")
 		}
 	}
 
@@ -137,44 +206,154 @@ func parseNetworkGenericOptions(data interface{}) (map[string]string, error) {
 	return options, err
 }
 
-func parseNetworkOptions(id string, option options.Generic) (map[string]string, error) {
+// parseEndpointOptions returns the driver options given to an endpoint,
+// such as with docker run --network name=x,driver-opt=key=value
+func parseEndpointOptions(data map[string]interface{}) map[string]string {
+	options := make(map[string]string)
+
+	for key, value := range data {
+		if str, ok := value.(string); ok {
+			options[key] = str
+		}
+	}
+	return options
+}
+
+func parseNetworkOptions(log *logrus.Entry, id string, option options.Generic, defaults map[string]string) (map[string]string, error) {
 	// parse generic labels first
 	genData, ok := option[netlabel.GenericData]
 	if ok && genData != nil {
-		options, err := parseNetworkGenericOptions(genData)
+		options, err := parseNetworkGenericOptions(log, genData, defaults)
 
 		return options, err
 	}
 	return nil, fmt.Errorf("invalid options")
 }
 
-func (d *driver) createNetwork(nid string, options map[string]string,
-	ipv4Data *network.IPAMData, storeConfig bool) error {
+// options selecting the PFs of a network, of which one is given
+var pfSelectorKeys = map[string]bool{networkDevice: true, pfPciAddress: true, pfMacAddress: true}
+
+// pfSelectors returns the PF selecting options given.
+func pfSelectors(options map[string]string) []string {
+	var selectors []string
+	for _, key := range []string{networkDevice, pfPciAddress, pfMacAddress} {
+		if options[key] != "" {
+			selectors = append(selectors, key)
+		}
+	}
+	return selectors
+}
+
+func hasPfSelector(options map[string]string) bool {
+	return len(pfSelectors(options)) > 0
+}
+
+// resolveNetworkDevice sets the netdevice option of a network given by
+// its pci or pf_mac option. Unlike netdevice names, these stay the same
+// across kernel and firmware upgrades.
+func resolveNetworkDevice(log *logrus.Entry, hw Hardware, options map[string]string) error {
+	var resolve func(string) (string, error)
+	var selector string
+
+	selectors := pfSelectors(options)
+	if len(selectors) == 1 {
+		selector = selectors[0]
+	}
+	if len(selectors) > 1 {
+		return fmt.Errorf("only one of %s, %s and %s can be given", networkDevice, pfPciAddress, pfMacAddress)
+	}
+
+	switch selector {
+	case pfPciAddress:
+		resolve = hw.GetNetdevByPciAddress
+	case pfMacAddress:
+		resolve = hw.GetNetdevByMacAddress
+	default:
+		return nil
+	}
+
+	var names []string
+	for _, item := range strings.Split(options[selector], ",") {
+		name, err := resolve(strings.TrimSpace(item))
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	options[networkDevice] = strings.Join(names, ",")
+	log.Infof("Resolved %s=%s to netdevice %s", selector, options[selector], options[networkDevice])
+	return nil
+}
+
+// pfPciAddresses returns the PCI addresses of the PFs of a network, as far
+// as they are PCI devices.
+func pfPciAddresses(hw Hardware, nw NwIface) []string {
+	var addrs []string
+
+	pfNames := []string{nw.getGenNw().ndevName}
+	if sriovNw, ok := nw.(*sriovNetwork); ok {
+		pfNames = sriovNw.pfNames
+	}
+	for _, name := range pfNames {
+		pciAddr, err := hw.GetPciAddress(name)
+		if err == nil {
+			addrs = append(addrs, pciAddr)
+		}
+	}
+	return addrs
+}
+
+func (d *driver) createNetwork(log *logrus.Entry, nid string, options map[string]string,
+	ipv4Data *network.IPAMData, ipv6Data *network.IPAMData, storeConfig bool) error {
 	var err error
 
-	genNw := createGenNw(nid, options[networkDevice], options[networkMode], options[ethPrefix], ipv4Data)
+	err = resolveNetworkDevice(log, d.hw, options)
+	if err != nil {
+		return err
+	}
+
+	genNw := createGenNw(nid, options[networkDevice], options[networkMode], options[ethPrefix], ipv4Data, ipv6Data)
+	genNw.driver = d
+	if storeConfig {
+		genNw.created = time.Now()
+	}
 
 	var nw NwIface
 	if options[networkMode] == "passthrough" {
 		nw = &ptNetwork{}
 	} else {
-		log.Println("Single port driver for device: ", options[networkDevice])
 		nw = &sriovNetwork{}
 	}
 
-	err = nw.CreateNetwork(d, genNw, nid, options, ipv4Data)
+	err = nw.CreateNetwork(log, d, genNw, nid, options, ipv4Data, ipv6Data)
 	if err != nil {
 		return err
 	}
-	d.networks[nid] = nw
+	d.addNetwork(nid, nw)
 
 	if storeConfig == true {
 		nwDbEntry := DbNetworkInfo{}
 		nwDbEntry.Mode = options[networkMode]
 		nwDbEntry.Netdev = options[networkDevice]
 		nwDbEntry.Vlan, _ = strconv.Atoi(options[sriovVlan])
-		nwDbEntry.Gateway = ipv4Data.Gateway
+		if ipv4Data != nil {
+			nwDbEntry.Gateway = ipv4Data.Gateway
+		}
+		if ipv6Data != nil {
+			nwDbEntry.GatewayIPv6 = ipv6Data.Gateway
+		}
 		nwDbEntry.Prefix = options[ethPrefix]
+		nwDbEntry.MinTxRate, _ = strconv.Atoi(options[minTxRate])
+		nwDbEntry.MaxTxRate, _ = strconv.Atoi(options[maxTxRate])
+		nwDbEntry.NumVfs, _ = strconv.Atoi(options[sriovNumVfs])
+		nwDbEntry.VfDriver = options[vfDriver]
+		nwDbEntry.AllocStrategy = options[allocStrategy]
+		nwDbEntry.PciAddress = options[pfPciAddress]
+		nwDbEntry.PfMac = options[pfMacAddress]
+		nwDbEntry.PfPciAddresses = pfPciAddresses(d.hw, nw)
+		if sriovNw, ok := nw.(*sriovNetwork); ok {
+			nwDbEntry.SriovOwners = sriovNw.sriovOwners
+		}
 
 		if options[networkPrivileged] == "1" {
 			nwDbEntry.Privileged = true
@@ -182,71 +361,123 @@ func (d *driver) createNetwork(nid string, options map[string]string,
 			nwDbEntry.Privileged = false
 		}
 
-		err = WriteNwConfigToDB(nid, &nwDbEntry)
+		err = d.store.Update(func(tx StoreTx) error {
+			return tx.PutNetwork(nid, &nwDbEntry)
+		})
 		if err != nil {
-			return err
+			// unregister the network, so its PF references and the
+			// SR-IOV it enabled go and a retry can succeed
+			d.removeNetwork(log, nid)
+			return fmt.Errorf("Fail to store network: %v", err)
 		}
 	}
 
 	return nil
 }
 
-func (d *driver) CreateNetwork(req *network.CreateNetworkRequest) error {
+func (d *driver) CreateNetwork(log *logrus.Entry, req *network.CreateNetworkRequest) error {
 	var err error
 
-	log.Printf("CreateNetwork() : [ %+v ]\n", req)
-	log.Printf("CreateNetwork IPv4Data len : [ %v ]\n", len(req.IPv4Data))
+	log.Debugf("CreateNetwork() %+v", req)
 
 	d.Lock()
 	defer d.Unlock()
 
-	if req.IPv4Data == nil || len(req.IPv4Data) == 0 {
+	if len(req.IPv4Data) == 0 && len(req.IPv6Data) == 0 {
 		return fmt.Errorf("Network gateway config miss.")
 	}
 
-	options, ret := parseNetworkOptions(req.NetworkID, req.Options)
+	options, ret := parseNetworkOptions(log, req.NetworkID, req.Options, d.config.NetworkDefaults)
 	if ret != nil {
-		log.Printf("CreateNetwork network options parse error")
 		return ret
 	}
 
-	ipv4Data := req.IPv4Data[0]
+	var ipv4Data, ipv6Data *network.IPAMData
+	if len(req.IPv4Data) > 0 {
+		ipv4Data = req.IPv4Data[0]
+	}
+	if len(req.IPv6Data) > 0 {
+		ipv6Data = req.IPv6Data[0]
+	}
 
-	err = d.createNetwork(req.NetworkID, options, ipv4Data, true)
+	err = d.createNetwork(log, req.NetworkID, options, ipv4Data, ipv6Data, true)
 	return err
 }
 
-func (d *driver) AllocateNetwork(r *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
-	log.Printf("AllocateNetwork() [ %+v ]\n", r)
+func (d *driver) AllocateNetwork(log *logrus.Entry, r *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
+	log.Debugf("AllocateNetwork() %+v", r)
 	return nil, nil
 }
 
-func (d *driver) DeleteNetwork(req *network.DeleteNetworkRequest) error {
-	log.Printf("DeleteNetwork() [ %+v ]\n", req)
+func (d *driver) DeleteNetwork(log *logrus.Entry, req *network.DeleteNetworkRequest) error {
+	log.Debugf("DeleteNetwork() %+v", req)
 
 	d.Lock()
 	defer d.Unlock()
 
-	nw := d.networks[req.NetworkID]
+	d.deleteNetwork(log, req)
+	return nil
+}
+
+// deleteNetwork tears down a network and its persisted state. Docker
+// deletes only networks without endpoints, but networks found stale may
+// still have some, whose VFs are released first. It must be called with
+// the driver lock held for writing.
+func (d *driver) deleteNetwork(log *logrus.Entry, req *network.DeleteNetworkRequest) {
+	releaseErrs := make(map[*ptEndpoint]error)
+	nw := d.getNetwork(req.NetworkID)
 	if nw != nil {
-		nw.DeleteNetwork(d, req)
+		genNw := nw.getGenNw()
+		genNw.lock.Lock()
+		endpoints := genNw.ndevEndpoints
+		genNw.ndevEndpoints = make(map[string]*ptEndpoint)
+		genNw.lock.Unlock()
+
+		for id, endpoint := range endpoints {
+			log.WithField(logFieldEndpoint, id).Info("Releasing endpoint of deleted network")
+			releaseErrs[endpoint] = nw.DeleteEndpoint(log.WithField(logFieldEndpoint, id), endpoint)
+		}
+		nw.DeleteNetwork(log, d, req)
 	}
 
-	delete(d.networks, req.NetworkID)
+	d.removeNetwork(log, req.NetworkID)
+	d.releaseReservedVfs(log, req.NetworkID)
+	d.metrics.vfAllocFailures.DeleteLabelValues(req.NetworkID)
 
-	DeleteNwConfigFromDB(req.NetworkID)
-	return nil
+	err := d.store.Update(func(tx StoreTx) error {
+		for endpoint, releaseErr := range releaseErrs {
+			err := storeVfRelease(tx, req.NetworkID, endpoint, releaseErr)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.DeleteNetwork(req.NetworkID)
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to delete stored network")
+	}
 }
 
-func (d *driver) FreeNetwork(r *network.FreeNetworkRequest) error {
-	log.Printf("FreeNetwork() [ %+v ]\n", r)
+func (d *driver) FreeNetwork(log *logrus.Entry, r *network.FreeNetworkRequest) error {
+	log.Debugf("FreeNetwork() %+v", r)
 	return nil
 }
 
-func BuildNetworkOptions(nwDbEntry *DbNetworkInfo) (map[string]string, error) {
+func BuildNetworkOptions(log *logrus.Entry, hw Hardware, nwDbEntry *DbNetworkInfo) (map[string]string, error) {
 	options := make(map[string]string)
 
-	options[networkDevice] = nwDbEntry.Netdev
+	switch {
+	case nwDbEntry.PciAddress != "":
+		options[pfPciAddress] = nwDbEntry.PciAddress
+	case nwDbEntry.PfMac != "":
+		options[pfMacAddress] = nwDbEntry.PfMac
+	case netdevsRenamed(hw, nwDbEntry):
+		// find the renamed netdevices by the PCI address they had
+		log.Warnf("Netdevice %s not found, using PCI address %v", nwDbEntry.Netdev, nwDbEntry.PfPciAddresses)
+		options[pfPciAddress] = strings.Join(nwDbEntry.PfPciAddresses, ",")
+	default:
+		options[networkDevice] = nwDbEntry.Netdev
+	}
 	options[networkMode] = nwDbEntry.Mode
 	options[sriovVlan] = strconv.Itoa(nwDbEntry.Vlan)
 	if nwDbEntry.Privileged {
@@ -255,99 +486,338 @@ func BuildNetworkOptions(nwDbEntry *DbNetworkInfo) (map[string]string, error) {
 		options[networkPrivileged] = "0"
 	}
 	options[ethPrefix] = nwDbEntry.Prefix
+	if nwDbEntry.MinTxRate > 0 {
+		options[minTxRate] = strconv.Itoa(nwDbEntry.MinTxRate)
+	}
+	if nwDbEntry.MaxTxRate > 0 {
+		options[maxTxRate] = strconv.Itoa(nwDbEntry.MaxTxRate)
+	}
+	if nwDbEntry.NumVfs > 0 {
+		options[sriovNumVfs] = strconv.Itoa(nwDbEntry.NumVfs)
+	}
+	options[vfDriver] = nwDbEntry.VfDriver
+	options[allocStrategy] = nwDbEntry.AllocStrategy
 	return options, nil
 }
 
+// netdevsRenamed reports whether a netdevice of a persisted network no
+// longer exists while its PCI address is known.
+func netdevsRenamed(hw Hardware, nwDbEntry *DbNetworkInfo) bool {
+	if len(nwDbEntry.PfPciAddresses) == 0 || strings.ContainsAny(nwDbEntry.Netdev, "*?[") {
+		return false
+	}
+	for _, name := range strings.Split(nwDbEntry.Netdev, ",") {
+		if !hw.NetdevExists(strings.TrimSpace(name)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *driver) CreatePersistentNetworks() error {
-	nwList, err := ReadAllNwConfigs(persistConfigPath)
+	var nwList map[string]*DbNetworkInfo
+	err := d.store.View(func(tx StoreTx) error {
+		var err error
+		nwList, err = tx.Networks()
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
 	for id, info := range nwList {
-		options, _ := BuildNetworkOptions(info)
+		log := logger.WithField(logFieldNetwork, id)
+		options, _ := BuildNetworkOptions(log, d.hw, info)
 
-		ipv4Data := network.IPAMData{}
-		ipv4Data.Gateway = info.Gateway
+		var ipv4Data, ipv6Data *network.IPAMData
+		if info.Gateway != "" {
+			ipv4Data = &network.IPAMData{Gateway: info.Gateway}
+		}
+		if info.GatewayIPv6 != "" {
+			ipv6Data = &network.IPAMData{Gateway: info.GatewayIPv6}
+		}
 
 		/* Create nw, but ignore the error.
 		 * This can happen when plugin is stopped and networks are
 		 * Deleted at the docker engine level, which plugin is
 		 * completely unaware of.
 		 */
-		_ = d.createNetwork(id, options, &ipv4Data, false)
+		err = d.createNetwork(log, id, options, ipv4Data, ipv6Data, false)
+		if err != nil {
+			log.WithError(err).Warn("Fail to restore network")
+			continue
+		}
+		if sriovNw, ok := d.getNetwork(id).(*sriovNetwork); ok {
+			sriovNw.restoreSriovOwners(info.SriovOwners)
+		}
+		d.restoreEndpoints(log, id)
 	}
+	d.reserveStoredVfs()
 	return nil
 }
 
-func (d *driver) ValidatePersistentNetworks() error {
-	nwList, err := ReadAllNwConfigs(persistConfigPath)
-	if err != nil {
+// reserveStoredVfs keeps the stored VFs of endpoints which were not
+// restored allocated, as their containers may still use them.
+func (d *driver) reserveStoredVfs() {
+	var vfList map[string]*DbVfInfo
+	err := d.store.View(func(tx StoreTx) error {
+		var err error
+		vfList, err = tx.Vfs()
 		return err
+	})
+	if err != nil {
+		logger.WithError(err).Error("Fail to read stored VFs")
+		return
 	}
 
-	validNetworks, err := GetNetworkList()
-	if err != nil {
-		return err
+	for pciAddr, info := range vfList {
+		if info.Quarantined != "" || d.vfHeldByEndpoint(pciAddr, info) {
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			logFieldNetwork: info.NetworkID, logFieldEndpoint: info.EndpointID,
+			logFieldPf: info.PfNetdev, logFieldVf: info.VfIndex,
+		}).Warn("Reserving VF of endpoint which was not restored")
+		d.reservedVfs[pciAddr] = info
+	}
+	for _, dev := range d.pfDevices {
+		d.applyReservedVfs(dev)
 	}
+}
 
-	d.Lock()
-	defer d.Unlock()
+func (d *driver) vfHeldByEndpoint(pciAddr string, info *DbVfInfo) bool {
+	nw := d.getNetwork(info.NetworkID)
+	if nw == nil {
+		return false
+	}
+	genNw := nw.getGenNw()
+	genNw.lock.Lock()
+	defer genNw.lock.Unlock()
+
+	endpoint := getEndpoint(genNw, info.EndpointID)
+	return endpoint != nil && endpoint.vfObj != nil && endpoint.vfObj.PciAddress == pciAddr
+}
 
-	for id, _ := range nwList {
-		_, valid := validNetworks[id]
-		if !valid {
-			nwDir := filepath.Join(persistConfigPath, id)
-			os.RemoveAll(nwDir)
-			log.Println("Deleting stale network: ", id)
+// applyReservedVfs marks the reserved VFs of a PF allocated.
+func (d *driver) applyReservedVfs(dev *pfDevice) {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
 
-			delete(d.networks, id)
+	for _, vf := range dev.pfHandle.List {
+		if d.reservedVfs[vf.PciAddress] != nil {
+			vf.Allocated = true
 		}
 	}
-	return nil
 }
 
-func (d *driver) loopValidatePersistentNetworks() {
-	for {
-		err := d.ValidatePersistentNetworks()
-		if err == nil {
-			break
+// restoreEndpoints rebuilds the endpoints of a persisted network so that
+// VFs held by running containers stay allocated across plugin restarts.
+func (d *driver) restoreEndpoints(log *logrus.Entry, nid string) {
+	nw := d.getNetwork(nid)
+
+	var epList map[string]*DbEndpointInfo
+	err := d.store.View(func(tx StoreTx) error {
+		var err error
+		epList, err = tx.Endpoints(nid)
+		return err
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to read endpoints")
+		return
+	}
+
+	for id, info := range epList {
+		epLog := log.WithField(logFieldEndpoint, id)
+		err = nw.RestoreEndpoint(epLog, id, info)
+		if err != nil {
+			epLog.WithError(err).Warn("Fail to restore endpoint")
+			continue
 		}
-		time.Sleep(time.Second * 5)
+		epLog.Info("Restored endpoint")
 	}
-	log.Printf("loopValidatePersistentNetworks() done")
 }
 
-func StartDriver() (*driver, error) {
-	driver := &driver{
-		networks: make(map[string]NwIface),
+// persistEndpoints stores the state of all endpoints in one transaction.
+func (d *driver) persistEndpoints() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	return d.store.Update(func(tx StoreTx) error {
+		for nid, nw := range d.networks {
+			genNw := nw.getGenNw()
+			genNw.lock.Lock()
+			for id, endpoint := range genNw.ndevEndpoints {
+				err := tx.PutEndpoint(nid, id, endpoint.dbEntry())
+				if err == nil && endpoint.vfObj != nil {
+					err = tx.PutVf(endpoint.vfObj.PciAddress, endpoint.dbVfEntry(nid))
+				}
+				if err != nil {
+					genNw.lock.Unlock()
+					return fmt.Errorf("Fail to store endpoint [ %s ]: %v", id, err)
+				}
+			}
+			genNw.lock.Unlock()
+		}
+		return nil
+	})
+}
+
+// Close closes the store of the driver.
+func (d *driver) Close() error {
+	return d.store.Close()
+}
+
+func (endpoint *ptEndpoint) dbEntry() *DbEndpointInfo {
+	epDbEntry := DbEndpointInfo{}
+	epDbEntry.DevName = endpoint.devName
+	epDbEntry.PfNetdev = endpoint.pfName
+	epDbEntry.Address = endpoint.Address
+	epDbEntry.SandboxKey = endpoint.sandboxKey
+	epDbEntry.MinTxRate = endpoint.minTxRate
+	epDbEntry.MaxTxRate = endpoint.maxTxRate
+	epDbEntry.VfBaseMac = endpoint.vfBaseMac
+	epDbEntry.BaseHopLimit = endpoint.baseHopLimit
+	epDbEntry.HopLimitSet = endpoint.hopLimitSet
+	epDbEntry.OrigVfDriver = endpoint.origVfDriver
+	epDbEntry.VfioBound = endpoint.vfioBound
+	epDbEntry.IommuGroup = endpoint.iommuGroup
+	if endpoint.vfObj != nil {
+		epDbEntry.VfIndex = endpoint.vfObj.Index
+		epDbEntry.VfPciAddress = endpoint.vfObj.PciAddress
+	}
+	return &epDbEntry
+}
+
+// dbVfEntry returns the record of the VF allocated to the endpoint.
+func (endpoint *ptEndpoint) dbVfEntry(nid string) *DbVfInfo {
+	return &DbVfInfo{
+		PfNetdev:   endpoint.pfName,
+		VfIndex:    endpoint.vfObj.Index,
+		NetworkID:  nid,
+		EndpointID: endpoint.id,
 	}
+}
 
-	err := driver.CreatePersistentNetworks()
+// storeQuarantine stores the quarantine of the VF of an endpoint which is
+// not stored.
+func (d *driver) storeQuarantine(log *logrus.Entry, nid string, endpoint *ptEndpoint, reason error) {
+	err := d.store.Update(func(tx StoreTx) error {
+		return storeVfRelease(tx, nid, endpoint, reason)
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to store quarantined VF")
+	}
+}
+
+// storeVfRelease updates the record of the VF of a deleted endpoint: it is
+// dropped once the VF is freed, and kept marked quarantined otherwise.
+func storeVfRelease(tx StoreTx, nid string, endpoint *ptEndpoint, releaseErr error) error {
+	if endpoint.vfObj == nil {
+		return nil
+	}
+	if releaseErr == nil {
+		return tx.DeleteVf(endpoint.vfObj.PciAddress)
+	}
+	vf := endpoint.dbVfEntry(nid)
+	vf.Quarantined = releaseErr.Error()
+	return tx.PutVf(endpoint.vfObj.PciAddress, vf)
+}
+
+func StartDriver(config *Config) (*driver, error) {
+	return StartDriverWithHardware(NewSysfsHardware(), config)
+}
+
+// StartDriverWithHardware starts the driver on the given PFs and VFs,
+// such as fake ones.
+func StartDriverWithHardware(hw Hardware, config *Config) (*driver, error) {
+	driver, err := NewDriver(hw, config)
 	if err != nil {
 		return nil, err
 	}
 
-	go driver.loopValidatePersistentNetworks()
+	go driver.runReconciler()
 
 	return driver, nil
 }
 
-func (d *driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
-	d.Lock()
-	defer d.Unlock()
+// NewDriver creates a driver with its persisted networks, without
+// reconciling them with the networks known to Docker.
+func NewDriver(hw Hardware, config *Config) (*driver, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	SetLogLevel(config.LogLevel)
+	SetLogFormat(config.LogFormat)
 
-	log.Printf("CreateEndpoint() [ %+v ]\n", r)
-	log.Printf("r.Interface: [ %+v ]\n", r.Interface)
+	store, err := OpenStore(config.StateBackend, config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	driver := &driver{
+		networks:         make(map[string]NwIface),
+		pfDevices:        make(map[string]*pfDevice),
+		reservedVfs:      make(map[string]*DbVfInfo),
+		hw:               hw,
+		store:            store,
+		docker:           dockerAPI{},
+		reconcileTrigger: make(chan struct{}, 1),
+		config:           *config,
+	}
+	driver.metrics = newMetrics(driver)
 
-	nw := d.networks[r.NetworkID]
+	err = driver.CreatePersistentNetworks()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return driver, nil
+}
+
+func (d *driver) CreateEndpoint(log *logrus.Entry, r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	log.Debugf("CreateEndpoint() %+v interface %+v", r, r.Interface)
+
+	nw := d.getNetwork(r.NetworkID)
 	if nw == nil {
 		return nil, fmt.Errorf("Plugin can not find network [ %s ].", r.NetworkID)
 	}
 
-	return nw.CreateEndpoint(r)
+	resp, err := nw.CreateEndpoint(log, r)
+	if err != nil {
+		return nil, err
+	}
+
+	genNw := nw.getGenNw()
+	genNw.lock.Lock()
+	endpoint := getEndpoint(genNw, r.EndpointID)
+	dbEntry := endpoint.dbEntry()
+	genNw.lock.Unlock()
+
+	err = d.store.Update(func(tx StoreTx) error {
+		err := tx.PutEndpoint(r.NetworkID, r.EndpointID, dbEntry)
+		if err != nil || endpoint.vfObj == nil {
+			return err
+		}
+		return tx.PutVf(endpoint.vfObj.PciAddress, endpoint.dbVfEntry(r.NetworkID))
+	})
+	if err != nil {
+		genNw.lock.Lock()
+		delete(genNw.ndevEndpoints, r.EndpointID)
+		genNw.lock.Unlock()
+		releaseErr := nw.DeleteEndpoint(log, endpoint)
+		if releaseErr != nil {
+			d.storeQuarantine(log, r.NetworkID, endpoint, releaseErr)
+		}
+		return nil, fmt.Errorf("Fail to store endpoint [ %s ]: %v", r.EndpointID, err)
+	}
+	return resp, nil
 }
 
+// getEndpoint must be called with genNw.lock held.
 func getEndpoint(genNw *genericNetwork, endpointID string) *ptEndpoint {
 	return genNw.ndevEndpoints[endpointID]
 }
@@ -356,23 +826,26 @@ func (nw *ptNetwork) getGenNw() *genericNetwork {
 	return nw.genNw
 }
 
+// getGenNwFromNetworkID must be called with the driver lock held.
 func (d *driver) getGenNwFromNetworkID(networkID string) *genericNetwork {
-	nw := d.networks[networkID]
+	nw := d.getNetwork(networkID)
 	if nw == nil {
 		return nil
 	}
 	return nw.getGenNw()
 }
 
-func (d *driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, error) {
-	log.Printf("EndpointInfo: [ %+v ]\n", r)
-	d.Lock()
-	defer d.Unlock()
+func (d *driver) EndpointInfo(log *logrus.Entry, r *network.InfoRequest) (*network.InfoResponse, error) {
+	log.Debugf("EndpointInfo() %+v", r)
+	d.RLock()
+	defer d.RUnlock()
 
 	genNw := d.getGenNwFromNetworkID(r.NetworkID)
 	if genNw == nil {
 		return nil, fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
 	}
+	genNw.lock.Lock()
+	defer genNw.lock.Unlock()
 
 	endpoint := getEndpoint(genNw, r.EndpointID)
 	if endpoint == nil {
@@ -382,23 +855,45 @@ func (d *driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, er
 	value := make(map[string]string)
 	value["id"] = endpoint.id
 	value["srcName"] = endpoint.devName
+	if endpoint.vfObj != nil {
+		value["pciAddress"] = endpoint.vfObj.PciAddress
+	}
+	if endpoint.iommuGroup != "" {
+		value["iommuGroup"] = endpoint.iommuGroup
+		value["vfioDevice"] = "/dev/vfio/" + endpoint.iommuGroup
+	}
 	resp := &network.InfoResponse{
 		Value: value,
 	}
-	log.Printf("EndpointInfo resp.Value : [ %+v ]\n", resp.Value)
+	log.WithField("value", resp.Value).Debug("EndpointInfo response")
 	return resp, nil
 }
 
-func (d *driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
-	log.Printf("Join() [ %+v ]\n", r)
+// parseGateway returns the gateway address of the IPAM pool without its
+// prefix length, or an empty string when the pool has no gateway.
+func parseGateway(ipamData *network.IPAMData) (string, error) {
+	if ipamData == nil || ipamData.Gateway == "" {
+		return "", nil
+	}
+	gw, _, err := net.ParseCIDR(ipamData.Gateway)
+	if err != nil {
+		return "", fmt.Errorf("Parse gateway [%s] error: %s", ipamData.Gateway, err.Error())
+	}
+	return gw.String(), nil
+}
 
-	d.Lock()
-	defer d.Unlock()
+func (d *driver) Join(log *logrus.Entry, r *network.JoinRequest) (*network.JoinResponse, error) {
+	log.Debugf("Join() %+v", r)
+
+	d.RLock()
+	defer d.RUnlock()
 
 	genNw := d.getGenNwFromNetworkID(r.NetworkID)
 	if genNw == nil {
 		return nil, fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
 	}
+	genNw.lock.Lock()
+	defer genNw.lock.Unlock()
 
 	endpoint := getEndpoint(genNw, r.EndpointID)
 	if endpoint == nil {
@@ -408,33 +903,54 @@ func (d *driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
 	if endpoint.sandboxKey != "" {
 		return nil, fmt.Errorf("Endpoint [%s] has bean bind to sandbox [%s]", r.EndpointID, endpoint.sandboxKey)
 	}
-	gw, _, err := net.ParseCIDR(genNw.IPv4Data.Gateway)
+	gw, err := parseGateway(genNw.IPv4Data)
+	if err != nil {
+		return nil, err
+	}
+	gw6, err := parseGateway(genNw.IPv6Data)
 	if err != nil {
-		return nil, fmt.Errorf("Parse gateway [%s] error: %s", genNw.IPv4Data.Gateway, err.Error())
+		return nil, err
 	}
 	endpoint.sandboxKey = r.SandboxKey
+	dbEntry := endpoint.dbEntry()
+	err = d.store.Update(func(tx StoreTx) error {
+		return tx.PutEndpoint(r.NetworkID, r.EndpointID, dbEntry)
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to store endpoint")
+	}
 	resp := network.JoinResponse{
 		InterfaceName: network.InterfaceName{
 			SrcName:   endpoint.devName,
 			DstPrefix: genNw.ethPrefix,
 		},
 		DisableGatewayService: false,
-		Gateway:               gw.String(),
+		Gateway:               gw,
+		GatewayIPv6:           gw6,
+	}
+	if endpoint.devName == "" {
+		// a VF bound to vfio-pci moves no netdevice into the container,
+		// so there is no interface to route through the gateways
+		resp.Gateway = ""
+		resp.GatewayIPv6 = ""
+		resp.DisableGatewayService = true
 	}
 
-	log.Printf("Join resp : [ %+v ]\n", resp)
+	log.WithField("sandbox", r.SandboxKey).Infof("Joined with netdevice %s", endpoint.devName)
 	return &resp, nil
 }
 
-func (d *driver) Leave(r *network.LeaveRequest) error {
-	log.Printf("Leave(): [ %+v ]\n", r)
-	d.Lock()
-	defer d.Unlock()
+func (d *driver) Leave(log *logrus.Entry, r *network.LeaveRequest) error {
+	log.Debugf("Leave() %+v", r)
+	d.RLock()
+	defer d.RUnlock()
 
 	genNw := d.getGenNwFromNetworkID(r.NetworkID)
 	if genNw == nil {
 		return fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
 	}
+	genNw.lock.Lock()
+	defer genNw.lock.Unlock()
 
 	endpoint := getEndpoint(genNw, r.EndpointID)
 	if endpoint == nil {
@@ -442,74 +958,105 @@ func (d *driver) Leave(r *network.LeaveRequest) error {
 	}
 
 	endpoint.sandboxKey = ""
+	dbEntry := endpoint.dbEntry()
+	err := d.store.Update(func(tx StoreTx) error {
+		return tx.PutEndpoint(r.NetworkID, r.EndpointID, dbEntry)
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to store endpoint")
+	}
+	log.Info("Left sandbox")
 	return nil
 }
 
-func (d *driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
-	log.Printf("DeleteEndpoint() [ %+v ]\n", r)
+func (d *driver) DeleteEndpoint(log *logrus.Entry, r *network.DeleteEndpointRequest) error {
+	log.Debugf("DeleteEndpoint() %+v", r)
 
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
 	genNw := d.getGenNwFromNetworkID(r.NetworkID)
 	if genNw == nil {
 		return fmt.Errorf("Can not find network [ %s ].", r.NetworkID)
 	}
 
+	// take the endpoint out first, so that it is released only once
+	genNw.lock.Lock()
 	endpoint := getEndpoint(genNw, r.EndpointID)
+	delete(genNw.ndevEndpoints, r.EndpointID)
+	genNw.lock.Unlock()
 	if endpoint == nil {
 		return fmt.Errorf("Cannot find endpoint by id: %s", r.EndpointID)
 	}
 
-	nw := d.networks[r.NetworkID]
+	nw := d.getNetwork(r.NetworkID)
 
-	nw.DeleteEndpoint(endpoint)
-	delete(genNw.ndevEndpoints, r.EndpointID)
+	releaseErr := nw.DeleteEndpoint(log, endpoint)
+
+	err := d.store.Update(func(tx StoreTx) error {
+		err := tx.DeleteEndpoint(r.NetworkID, r.EndpointID)
+		if err != nil {
+			return err
+		}
+		return storeVfRelease(tx, r.NetworkID, endpoint, releaseErr)
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to delete stored endpoint")
+	}
 	return nil
 }
 
-func (d *driver) DiscoverNew(r *network.DiscoveryNotification) error {
-	log.Printf("DiscoverNew(): [ %+v ]\n", r)
+func (d *driver) DiscoverNew(log *logrus.Entry, r *network.DiscoveryNotification) error {
+	log.Debugf("DiscoverNew() %+v", r)
 	return nil
 }
 
-func (d *driver) DiscoverDelete(r *network.DiscoveryNotification) error {
-	log.Printf("DiscoverDelete: [ %+v ]\n", r)
+func (d *driver) DiscoverDelete(log *logrus.Entry, r *network.DiscoveryNotification) error {
+	log.Debugf("DiscoverDelete() %+v", r)
 	return nil
 }
 
-func (d *driver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) error {
-	log.Printf("ProgramExternalConnectivity(): [ %+v ]\n", r)
+func (d *driver) ProgramExternalConnectivity(log *logrus.Entry, r *network.ProgramExternalConnectivityRequest) error {
+	log.Debugf("ProgramExternalConnectivity() %+v", r)
 	return nil
 }
 
-func (d *driver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) error {
-	log.Printf("RevokeExternalConnectivity(): [ %+v ]\n", r)
+func (d *driver) RevokeExternalConnectivity(log *logrus.Entry, r *network.RevokeExternalConnectivityRequest) error {
+	log.Debugf("RevokeExternalConnectivity() %+v", r)
 	return nil
 }
 
-func (pt *ptNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
+func (pt *ptNetwork) CreateNetwork(log *logrus.Entry, d *driver, genNw *genericNetwork,
 	nid string, options map[string]string,
-	ipv4Data *network.IPAMData) error {
+	ipv4Data *network.IPAMData, ipv6Data *network.IPAMData) error {
 
+	if strings.ContainsAny(genNw.ndevName, ",*?[") {
+		return fmt.Errorf("passthrough mode supports only one netdevice")
+	}
 	pt.genNw = genNw
 
-	log.Printf("PT CreateNetwork : [%s] IPv4Data : [ %+v ]\n", pt.genNw.id, pt.genNw.IPv4Data)
+	log.WithFields(logrus.Fields{logFieldPf: genNw.ndevName, "ipv4": pt.genNw.IPv4Data, "ipv6": pt.genNw.IPv6Data}).
+		Info("Created passthrough network")
 	return nil
 }
 
-func (pt *ptNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkRequest) {
+func (pt *ptNetwork) DeleteNetwork(log *logrus.Entry, d *driver, req *network.DeleteNetworkRequest) {
 
 }
 
-func (nw *ptNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+func (nw *ptNetwork) CreateEndpoint(log *logrus.Entry, r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	nw.genNw.lock.Lock()
+	defer nw.genNw.lock.Unlock()
+
 	if len(nw.genNw.ndevEndpoints) > 0 {
 		return nil, fmt.Errorf("supports only one device")
 	}
 
 	ndev := &ptEndpoint{
+		id:      r.EndpointID,
 		devName: nw.genNw.ndevName,
 		Address: r.Interface.Address,
+		created: time.Now(),
 	}
 	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
 
@@ -518,10 +1065,28 @@ func (nw *ptNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.
 		endpointInterface.Address = ndev.Address
 	}
 	resp := &network.CreateEndpointResponse{Interface: endpointInterface}
-	log.Printf("PT CreateEndpoint resp interface: [ %+v ] ", resp.Interface)
+	log.WithField(logFieldPf, ndev.devName).Infof("Created endpoint with address %s", ndev.Address)
 	return resp, nil
 }
 
-func (nw *ptNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
+func (nw *ptNetwork) DeleteEndpoint(log *logrus.Entry, endpoint *ptEndpoint) error {
+	return nil
+}
+
+func (nw *ptNetwork) RestoreEndpoint(log *logrus.Entry, id string, info *DbEndpointInfo) error {
+	nw.genNw.lock.Lock()
+	defer nw.genNw.lock.Unlock()
 
+	if len(nw.genNw.ndevEndpoints) > 0 {
+		return fmt.Errorf("supports only one device")
+	}
+
+	ndev := &ptEndpoint{
+		id:         id,
+		devName:    nw.genNw.ndevName,
+		Address:    info.Address,
+		sandboxKey: info.SandboxKey,
+	}
+	nw.genNw.ndevEndpoints[id] = ndev
+	return nil
 }
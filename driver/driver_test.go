@@ -0,0 +1,611 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/internal/fakehw"
+)
+
+var errDeviceBusy = fmt.Errorf("device busy")
+
+const (
+	testNetworkID  = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	testEndpointID = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	testSandboxKey = "/var/run/docker/netns/0123456789ab"
+)
+
+func testLog(t *testing.T) *logrus.Entry {
+	return logger.WithField("test", t.Name())
+}
+
+func testConfig(t *testing.T) *Config {
+	config := DefaultConfig()
+	config.StateDir = filepath.Join(t.TempDir(), "state")
+	return config
+}
+
+// startTestDriver starts a driver on fake hardware, without reconciling
+// with Docker.
+func startTestDriver(t *testing.T, hw *fakehw.Hardware, config *Config) *driver {
+	d, err := NewDriver(hw, config)
+	if err != nil {
+		t.Fatalf("NewDriver: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func createNetworkRequest(nid string, options map[string]interface{}) *network.CreateNetworkRequest {
+	return &network.CreateNetworkRequest{
+		NetworkID: nid,
+		Options:   map[string]interface{}{"com.docker.network.generic": options},
+		IPv4Data: []*network.IPAMData{{
+			AddressSpace: "LocalDefault",
+			Pool:         "192.168.100.0/24",
+			Gateway:      "192.168.100.1/24",
+		}},
+	}
+}
+
+func createEndpointRequest(nid string, eid string, options map[string]interface{}) *network.CreateEndpointRequest {
+	return &network.CreateEndpointRequest{
+		NetworkID:  nid,
+		EndpointID: eid,
+		Interface:  &network.EndpointInterface{Address: "192.168.100.2/24"},
+		Options:    options,
+	}
+}
+
+// runLifecycle starts and removes a container on a network like docker run
+// and docker rm do. check is called with the endpoint info while the
+// container runs.
+func runLifecycle(t *testing.T, d *driver, nid string, eid string, check func(info map[string]string)) {
+	log := testLog(t)
+
+	_, err := d.CreateEndpoint(log, createEndpointRequest(nid, eid, map[string]interface{}{}))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	info, err := d.EndpointInfo(log, &network.InfoRequest{NetworkID: nid, EndpointID: eid})
+	if err != nil {
+		t.Fatalf("EndpointInfo: %v", err)
+	}
+
+	join, err := d.Join(log, &network.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: testSandboxKey})
+	if err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	if join.InterfaceName.SrcName != info.Value["srcName"] || join.InterfaceName.DstPrefix != containerVethPrefix {
+		t.Errorf("Join returned interface %+v, expected %s", join.InterfaceName, info.Value["srcName"])
+	}
+	if join.Gateway != "192.168.100.1" {
+		t.Errorf("Join returned gateway %s, expected 192.168.100.1", join.Gateway)
+	}
+	_, err = d.Join(log, &network.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: testSandboxKey})
+	if err == nil {
+		t.Errorf("second Join succeeded")
+	}
+
+	if check != nil {
+		check(info.Value)
+	}
+
+	err = d.Leave(log, &network.LeaveRequest{NetworkID: nid, EndpointID: eid})
+	if err != nil {
+		t.Fatalf("Leave: %v", err)
+	}
+	err = d.DeleteEndpoint(log, &network.DeleteEndpointRequest{NetworkID: nid, EndpointID: eid})
+	if err != nil {
+		t.Fatalf("DeleteEndpoint: %v", err)
+	}
+	err = d.DeleteEndpoint(log, &network.DeleteEndpointRequest{NetworkID: nid, EndpointID: eid})
+	if err == nil {
+		t.Errorf("second DeleteEndpoint succeeded")
+	}
+}
+
+func storedEndpoints(t *testing.T, d *driver, nid string) map[string]*DbEndpointInfo {
+	var epList map[string]*DbEndpointInfo
+	err := d.store.View(func(tx StoreTx) error {
+		var err error
+		epList, err = tx.Endpoints(nid)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("reading stored endpoints: %v", err)
+	}
+	return epList
+}
+
+func TestPassthroughLifecycle(t *testing.T) {
+	hw := fakehw.New()
+	hw.AddPf("ens1f0", 8, 0)
+	d := startTestDriver(t, hw, testConfig(t))
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID,
+		map[string]interface{}{"netdevice": "ens1f0", "mode": "passthrough"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+
+	runLifecycle(t, d, testNetworkID, testEndpointID, func(info map[string]string) {
+		if info["srcName"] != "ens1f0" {
+			t.Errorf("endpoint takes %s, expected the PF itself", info["srcName"])
+		}
+		// a passthrough network hands out its only netdevice once
+		_, err := d.CreateEndpoint(log, createEndpointRequest(testNetworkID, "other", nil))
+		if err == nil {
+			t.Errorf("second endpoint created on passthrough network")
+		}
+	})
+
+	err = d.DeleteNetwork(log, &network.DeleteNetworkRequest{NetworkID: testNetworkID})
+	if err != nil {
+		t.Fatalf("DeleteNetwork: %v", err)
+	}
+	if d.getNetwork(testNetworkID) != nil {
+		t.Errorf("network still known after DeleteNetwork")
+	}
+}
+
+func TestSriovLifecycle(t *testing.T) {
+	hw := fakehw.New()
+	pf := hw.AddPf("ens1f0", 8, 4)
+	d := startTestDriver(t, hw, testConfig(t))
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{
+		"netdevice":   "ens1f0",
+		"vlan":        "100",
+		"privileged":  "1",
+		"max_tx_rate": "1000",
+	}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+
+	runLifecycle(t, d, testNetworkID, testEndpointID, func(info map[string]string) {
+		vf := pf.Vfs[0]
+		if info["pciAddress"] != vf.PciAddress || info["srcName"] != vf.Netdev {
+			t.Fatalf("endpoint has VF %s %s, expected %s %s",
+				info["pciAddress"], info["srcName"], vf.PciAddress, vf.Netdev)
+		}
+		if vf.Info.Vlan != 100 || vf.Info.Trust != 1 || vf.Info.MaxTxRate != 1000 {
+			t.Errorf("VF config is %+v, expected vlan 100, trusted and max tx rate 1000", vf.Info)
+		}
+		if d.getPfDevice("ens1f0").freeVfCount() != 3 {
+			t.Errorf("%d VFs free, expected 3", d.getPfDevice("ens1f0").freeVfCount())
+		}
+		if storedEndpoints(t, d, testNetworkID)[testEndpointID].SandboxKey != testSandboxKey {
+			t.Errorf("sandbox of the endpoint not stored")
+		}
+	})
+
+	vf := pf.Vfs[0]
+	if vf.Info.Vlan != 0 || vf.Info.Trust != 0 || !vf.Info.Spoofchk || vf.Info.MaxTxRate != 0 {
+		t.Errorf("VF config is %+v after release, expected the baseline", vf.Info)
+	}
+	if d.getPfDevice("ens1f0").freeVfCount() != 4 {
+		t.Errorf("%d VFs free after release, expected 4", d.getPfDevice("ens1f0").freeVfCount())
+	}
+	if len(storedEndpoints(t, d, testNetworkID)) != 0 {
+		t.Errorf("endpoint still stored after DeleteEndpoint")
+	}
+
+	err = d.DeleteNetwork(log, &network.DeleteNetworkRequest{NetworkID: testNetworkID})
+	if err != nil {
+		t.Fatalf("DeleteNetwork: %v", err)
+	}
+	if d.getNetwork(testNetworkID) != nil || d.getPfDevice("ens1f0") != nil {
+		t.Errorf("network or PF still known after DeleteNetwork")
+	}
+	if !hw.IsSriovEnabled("ens1f0") {
+		t.Errorf("SR-IOV enabled by the administrator was disabled")
+	}
+}
+
+func TestSriovNumVfs(t *testing.T) {
+	hw := fakehw.New()
+	hw.AddPf("ens1f0", 8, 0)
+	d := startTestDriver(t, hw, testConfig(t))
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID,
+		map[string]interface{}{"netdevice": "ens1f0", "numvfs": "2"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	if !hw.IsSriovEnabled("ens1f0") || len(hw.Pfs["ens1f0"].Vfs) != 2 {
+		t.Fatalf("numvfs did not enable 2 VFs")
+	}
+
+	runLifecycle(t, d, testNetworkID, testEndpointID, nil)
+
+	err = d.DeleteNetwork(log, &network.DeleteNetworkRequest{NetworkID: testNetworkID})
+	if err != nil {
+		t.Fatalf("DeleteNetwork: %v", err)
+	}
+	if hw.IsSriovEnabled("ens1f0") {
+		t.Errorf("SR-IOV enabled through numvfs still on after DeleteNetwork")
+	}
+}
+
+// failingStore is a store whose updates fail.
+type failingStore struct {
+	Store
+}
+
+func (s failingStore) Update(fn func(tx StoreTx) error) error {
+	return errDeviceBusy
+}
+
+func TestSriovStoreNetworkFailure(t *testing.T) {
+	hw := fakehw.New()
+	hw.AddPf("ens1f0", 8, 0)
+	d := startTestDriver(t, hw, testConfig(t))
+	log := testLog(t)
+	store := d.store
+	d.store = failingStore{store}
+
+	options := map[string]interface{}{"netdevice": "ens1f0", "numvfs": "2", "vlan": "10"}
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, options))
+	if err == nil {
+		t.Fatalf("CreateNetwork succeeded without storing the network")
+	}
+	if d.getNetwork(testNetworkID) != nil || d.getPfDevice("ens1f0") != nil {
+		t.Errorf("network left registered after failing to store it")
+	}
+	if hw.IsSriovEnabled("ens1f0") {
+		t.Errorf("SR-IOV enabled through numvfs still on")
+	}
+
+	d.store = store
+	err = d.CreateNetwork(log, createNetworkRequest(testNetworkID, options))
+	if err != nil {
+		t.Fatalf("retried CreateNetwork: %v", err)
+	}
+}
+
+func TestSriovRestart(t *testing.T) {
+	hw := fakehw.New()
+	hw.AddPf("ens1f0", 8, 4)
+	config := testConfig(t)
+	d := startTestDriver(t, hw, config)
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	_, err = d.CreateEndpoint(log, createEndpointRequest(testNetworkID, testEndpointID, nil))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	d.Close()
+
+	d = startTestDriver(t, hw, config)
+	info, err := d.EndpointInfo(log, &network.InfoRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	if err != nil {
+		t.Fatalf("endpoint not restored: %v", err)
+	}
+	if info.Value["pciAddress"] != hw.Pfs["ens1f0"].Vfs[0].PciAddress {
+		t.Errorf("endpoint restored with VF %s, expected the first one", info.Value["pciAddress"])
+	}
+	if d.getPfDevice("ens1f0").freeVfCount() != 3 {
+		t.Errorf("%d VFs free after restart, expected 3", d.getPfDevice("ens1f0").freeVfCount())
+	}
+}
+
+func storedVfs(t *testing.T, d *driver) map[string]*DbVfInfo {
+	var vfList map[string]*DbVfInfo
+	err := d.store.View(func(tx StoreTx) error {
+		var err error
+		vfList, err = tx.Vfs()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("reading stored VFs: %v", err)
+	}
+	return vfList
+}
+
+func TestSriovVfRecords(t *testing.T) {
+	hw := fakehw.New()
+	pf := hw.AddPf("ens1f0", 8, 4)
+	d := startTestDriver(t, hw, testConfig(t))
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	_, err = d.CreateEndpoint(log, createEndpointRequest(testNetworkID, testEndpointID, nil))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	vf := storedVfs(t, d)[pf.Vfs[0].PciAddress]
+	if vf == nil || vf.EndpointID != testEndpointID || vf.Quarantined != "" {
+		t.Fatalf("VF of the endpoint stored as %+v", vf)
+	}
+
+	pf.Vfs[0].FailReset = errDeviceBusy
+	err = d.DeleteEndpoint(log, &network.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	if err != nil {
+		t.Fatalf("DeleteEndpoint: %v", err)
+	}
+	vf = storedVfs(t, d)[pf.Vfs[0].PciAddress]
+	if vf == nil || vf.Quarantined == "" {
+		t.Fatalf("quarantined VF stored as %+v", vf)
+	}
+
+	pf.Vfs[0].FailReset = nil
+	err = d.releaseStuckVf("ens1f0", 0)
+	if err != nil {
+		t.Fatalf("releaseStuckVf: %v", err)
+	}
+	if len(storedVfs(t, d)) != 0 {
+		t.Errorf("VF still stored after release: %v", storedVfs(t, d))
+	}
+}
+
+func TestSriovQuarantineRestart(t *testing.T) {
+	hw := fakehw.New()
+	pf := hw.AddPf("ens1f0", 8, 4)
+	config := testConfig(t)
+	d := startTestDriver(t, hw, config)
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	pf.Vfs[0].FailReset = errDeviceBusy
+	runLifecycle(t, d, testNetworkID, testEndpointID, nil)
+	d.Close()
+
+	d = startTestDriver(t, hw, config)
+	dev := d.getPfDevice("ens1f0")
+	if dev.freeVfCount() != 3 || dev.quarantinedVfs[0] == "" {
+		t.Fatalf("%d VFs free and quarantine %v after restart, expected VF 0 quarantined",
+			dev.freeVfCount(), dev.quarantinedVfs)
+	}
+	_, err = d.CreateEndpoint(log, createEndpointRequest(testNetworkID, testEndpointID, nil))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	if storedEndpoints(t, d, testNetworkID)[testEndpointID].VfPciAddress == pf.Vfs[0].PciAddress {
+		t.Errorf("quarantined VF handed out after restart")
+	}
+}
+
+func TestSriovReserveUnrestoredVfs(t *testing.T) {
+	hw := fakehw.New()
+	pf := hw.AddPf("ens1f0", 8, 4)
+	config := testConfig(t)
+	d := startTestDriver(t, hw, config)
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	_, err = d.CreateEndpoint(log, createEndpointRequest(testNetworkID, testEndpointID, nil))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	// a network the restarted plugin does not restore, like one written
+	// by a newer plugin
+	err = d.store.Update(func(tx StoreTx) error {
+		return tx.PutVf(pf.Vfs[1].PciAddress, &DbVfInfo{PfNetdev: "ens1f0", VfIndex: 1,
+			NetworkID: "newer", EndpointID: "newer-endpoint"})
+	})
+	if err != nil {
+		t.Fatalf("PutVf: %v", err)
+	}
+	d.Close()
+
+	d = startTestDriver(t, hw, config)
+	dev := d.getPfDevice("ens1f0")
+	if dev.freeVfCount() != 2 {
+		t.Fatalf("%d VFs free after restart, expected 2", dev.freeVfCount())
+	}
+	adminDevs := d.adminPfDevices()
+	if len(adminDevs) != 1 || adminDevs[0].Vfs[1].ReservedFor != "newer-endpoint" {
+		t.Errorf("VF 1 not shown reserved: %+v", adminDevs)
+	}
+
+	err = d.releaseStuckVf("ens1f0", 1)
+	if err != nil {
+		t.Fatalf("releaseStuckVf: %v", err)
+	}
+	if dev.freeVfCount() != 3 || len(d.reservedVfs) != 0 {
+		t.Errorf("%d VFs free and %d reserved after release, expected 3 and none",
+			dev.freeVfCount(), len(d.reservedVfs))
+	}
+}
+
+func TestSriovAllocFailures(t *testing.T) {
+	hw := fakehw.New()
+	hw.AddPf("ens1f0", 8, 1)
+	hw.AddPf("ens1f1", 8, 1)
+	d := startTestDriver(t, hw, testConfig(t))
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID,
+		map[string]interface{}{"netdevice": "ens1f0,ens1f1"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	for _, eid := range []string{"first", "second", "third"} {
+		d.CreateEndpoint(log, createEndpointRequest(testNetworkID, eid, nil))
+	}
+	failures := testutil.ToFloat64(d.metrics.vfAllocFailures.WithLabelValues(testNetworkID))
+	if failures != 1 {
+		t.Errorf("%v allocation failures counted, expected 1", failures)
+	}
+
+	err = d.DeleteNetwork(log, &network.DeleteNetworkRequest{NetworkID: testNetworkID})
+	if err != nil {
+		t.Fatalf("DeleteNetwork: %v", err)
+	}
+	if series := testutil.CollectAndCount(d.metrics.vfAllocFailures); series != 0 {
+		t.Errorf("%d allocation failure series left after DeleteNetwork", series)
+	}
+}
+
+func TestSriovRestartAfterPfRename(t *testing.T) {
+	hw := fakehw.New()
+	pf := hw.AddPf("ens1f0", 8, 4)
+	config := testConfig(t)
+	d := startTestDriver(t, hw, config)
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	_, err = d.CreateEndpoint(log, createEndpointRequest(testNetworkID, testEndpointID, nil))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	d.Close()
+
+	hw.RenamePf("ens1f0", "enp59s0f0")
+	d = startTestDriver(t, hw, config)
+	info, err := d.EndpointInfo(log, &network.InfoRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	if err != nil {
+		t.Fatalf("endpoint not restored after PF rename: %v", err)
+	}
+	if info.Value["pciAddress"] != pf.Vfs[0].PciAddress {
+		t.Errorf("endpoint restored with VF %s, expected %s", info.Value["pciAddress"], pf.Vfs[0].PciAddress)
+	}
+
+	err = d.DeleteEndpoint(log, &network.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	if err != nil {
+		t.Fatalf("DeleteEndpoint: %v", err)
+	}
+	if d.getPfDevice("enp59s0f0").freeVfCount() != 4 {
+		t.Errorf("%d VFs free after DeleteEndpoint, expected 4", d.getPfDevice("enp59s0f0").freeVfCount())
+	}
+	if len(d.reservedVfs) != 0 {
+		t.Errorf("VFs %v reserved after PF rename", d.reservedVfs)
+	}
+}
+
+func TestSriovReserveVfsOfNewerNetwork(t *testing.T) {
+	hw := fakehw.New()
+	pf := hw.AddPf("ens1f0", 8, 4)
+	config := testConfig(t)
+	d := startTestDriver(t, hw, config)
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	_, err = d.CreateEndpoint(log, createEndpointRequest(testNetworkID, testEndpointID, nil))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	d.Close()
+
+	// the network as rewritten by a newer plugin
+	writeNetworkConfig(t, config.StateDir, testNetworkID,
+		fmt.Sprintf(`{"Version":%d,"Netdev":"ens1f0","Mode":"sriov"}`, nwSchemaVersion+1))
+	d = startTestDriver(t, hw, config)
+	if d.getNetwork(testNetworkID) != nil {
+		t.Fatalf("network written by a newer plugin restored")
+	}
+
+	nid := "other" + testNetworkID[5:]
+	err = d.CreateNetwork(log, createNetworkRequest(nid, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	dev := d.getPfDevice("ens1f0")
+	if dev.freeVfCount() != 3 {
+		t.Errorf("%d VFs free, expected 3", dev.freeVfCount())
+	}
+	adminDevs := d.adminPfDevices()
+	if len(adminDevs) != 1 || adminDevs[0].Vfs[0].ReservedFor != testEndpointID {
+		t.Errorf("VF %s of the skipped network not shown reserved: %+v", pf.Vfs[0].PciAddress, adminDevs)
+	}
+}
+
+// truncateFile cuts a file in half, as a crash of a plugin without atomic
+// writes could have left it.
+func truncateFile(t *testing.T, path string) {
+	info, err := os.Stat(path)
+	if err == nil {
+		err = os.Truncate(path, info.Size()/2)
+	}
+	if err != nil {
+		t.Fatalf("truncating %s: %v", path, err)
+	}
+}
+
+func TestQuarantineTruncatedFiles(t *testing.T) {
+	hw := fakehw.New()
+	hw.AddPf("ens1f0", 8, 4)
+	hw.AddPf("ens1f1", 8, 4)
+	config := testConfig(t)
+	d := startTestDriver(t, hw, config)
+	log := testLog(t)
+
+	damagedID := "damaged" + testNetworkID[7:]
+	for nid, pf := range map[string]string{damagedID: "ens1f0", testNetworkID: "ens1f1"} {
+		err := d.CreateNetwork(log, createNetworkRequest(nid, map[string]interface{}{"netdevice": pf}))
+		if err != nil {
+			t.Fatalf("CreateNetwork: %v", err)
+		}
+	}
+	for _, eid := range []string{testEndpointID, "damaged"} {
+		_, err := d.CreateEndpoint(log, createEndpointRequest(testNetworkID, eid, nil))
+		if err != nil {
+			t.Fatalf("CreateEndpoint: %v", err)
+		}
+	}
+	d.Close()
+
+	truncateFile(t, filepath.Join(config.StateDir, damagedID, "config.json"))
+	truncateFile(t, filepath.Join(config.StateDir, testNetworkID, "endpoints", "damaged.json"))
+	d = startTestDriver(t, hw, config)
+
+	if d.getNetwork(damagedID) != nil || d.getNetwork(testNetworkID) == nil {
+		t.Fatalf("networks restored are %v, expected %s", d.networkIDs(), testNetworkID)
+	}
+	genNw := d.getNetwork(testNetworkID).getGenNw()
+	if len(genNw.ndevEndpoints) != 1 || getEndpoint(genNw, testEndpointID) == nil {
+		t.Errorf("endpoints restored are %v, expected %s", genNw.ndevEndpoints, testEndpointID)
+	}
+	// the VF of the damaged endpoint stays reserved by its VF record
+	if d.getPfDevice("ens1f1").freeVfCount() != 2 {
+		t.Errorf("%d VFs free, expected 2", d.getPfDevice("ens1f1").freeVfCount())
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(config.StateDir, quarantineDir))
+	if err != nil {
+		t.Fatalf("reading quarantine: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 || !strings.HasPrefix(names[0], testNetworkID+"-endpoints-damaged.json.") ||
+		!strings.HasPrefix(names[1], damagedID+".") {
+		t.Errorf("quarantined files are %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(config.StateDir, damagedID)); !os.IsNotExist(err) {
+		t.Errorf("damaged network left in place")
+	}
+}
@@ -2,62 +2,235 @@ package driver
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	persistConfigPath = "/etc/docker/mellanox/docker-sriov-plugin"
+	// directory unreadable networks and endpoints are moved to
+	quarantineDir = ".quarantine"
+
+	// directory of the VF records
+	vfsDir = ".vfs"
 )
 
 /* Configuration layout
 config/
 		nw-1/
 			config.json
+			endpoints/
+				ep-1.json
+				ep-2.json
 		nw-2/
 		nw-3/
+		.quarantine/
+		.vfs/
+			0000:03:00.2.json
+
+Files are replaced atomically, and entries starting with a dot, such as
+files being written, are skipped when reading.
 */
 
-/* Network config.json */
-type DbNetworkInfo struct {
-	Version    uint32 `json:"Version"`
-	Netdev     string `json:"Netdevice"`
-	Mode       string `json:"Mode"`
-	Gateway    string `json:"Gateway"`
-	Vlan       int    `json:"vlan"`
-	Privileged bool   `json:"Privileged"`
-	Prefix     string `json:"Prefix"`
+// fileStore is the Store keeping a directory per network. Each file is
+// replaced atomically, but a crash while a transaction is applied can
+// leave some of its files written and others not.
+type fileStore struct {
+	dir string
+	// held for reading by views and for writing by updates
+	lock sync.RWMutex
+	// set for readers besides the plugin, which fail updates and leave
+	// unreadable entries in place
+	readOnly bool
+}
+
+// fileTx reads from the directory right away and queues writes until the
+// transaction is committed.
+type fileTx struct {
+	s        *fileStore
+	writable bool
+	writes   []func() error
+}
+
+func newFileStore(dir string) *fileStore {
+	return &fileStore{dir: dir}
+}
+
+func (s *fileStore) View(fn func(tx StoreTx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return fn(&fileTx{s: s})
+}
+
+func (s *fileStore) Update(fn func(tx StoreTx) error) error {
+	if s.readOnly {
+		return fmt.Errorf("store in %s is opened read only", s.dir)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx := &fileTx{s: s, writable: true}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	for _, write := range tx.writes {
+		err = write()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+func (tx *fileTx) queue(write func() error) error {
+	if !tx.writable {
+		return fmt.Errorf("write in a read-only transaction")
+	}
+	tx.writes = append(tx.writes, write)
+	return nil
+}
+
+func (tx *fileTx) Networks() (map[string]*DbNetworkInfo, error) {
+	return tx.s.readAllNwConfigs()
+}
+
+func (tx *fileTx) PutNetwork(nid string, nw *DbNetworkInfo) error {
+	return tx.queue(func() error { return tx.s.writeNwConfig(nid, nw) })
+}
+
+func (tx *fileTx) DeleteNetwork(nid string) error {
+	return tx.queue(func() error { return tx.s.deleteNwConfig(nid) })
+}
+
+func (tx *fileTx) Endpoints(nid string) (map[string]*DbEndpointInfo, error) {
+	return tx.s.readAllEndpoints(nid)
+}
+
+func (tx *fileTx) PutEndpoint(nid string, eid string, ep *DbEndpointInfo) error {
+	return tx.queue(func() error { return tx.s.writeEndpoint(nid, eid, ep) })
+}
+
+func (tx *fileTx) DeleteEndpoint(nid string, eid string) error {
+	return tx.queue(func() error { return tx.s.deleteEndpoint(nid, eid) })
+}
+
+func (tx *fileTx) Vfs() (map[string]*DbVfInfo, error) {
+	return tx.s.readAllVfs()
+}
+
+func (tx *fileTx) PutVf(pciAddr string, vf *DbVfInfo) error {
+	return tx.queue(func() error { return tx.s.writeVf(pciAddr, vf) })
+}
+
+func (tx *fileTx) DeleteVf(pciAddr string) error {
+	return tx.queue(func() error { return tx.s.deleteVf(pciAddr) })
 }
 
 func mkdirp(dir string) error {
 	return os.MkdirAll(dir, 0755)
 }
 
-func WriteNwConfigToDB(nwKey string, nw *DbNetworkInfo) error {
+// writeFileAtomic replaces a file with data, so that after a crash the
+// file has either its old or its new content.
+func writeFileAtomic(file string, data []byte) error {
+	dir := filepath.Dir(file)
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), os.FileMode(0644))
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames and removals in a directory durable.
+func syncDir(dir string) error {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return handle.Sync()
+}
+
+// quarantine moves an unreadable network directory or endpoint file out of
+// the way, so it is kept for inspection without failing startup. Read only
+// stores just skip it.
+func (s *fileStore) quarantine(path string, cause error) {
+	if s.readOnly {
+		logger.WithError(cause).Warnf("Skipping unreadable %s", path)
+		return
+	}
+
+	configDir := s.dir
+	name := strings.Replace(strings.TrimPrefix(path, configDir+string(filepath.Separator)),
+		string(filepath.Separator), "-", -1)
+	name = name + "." + time.Now().Format("20060102T150405")
+	target := filepath.Join(configDir, quarantineDir, name)
+
+	err := mkdirp(filepath.Dir(target))
+	if err == nil {
+		err = os.Rename(path, target)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("cause", cause).Errorf("Fail to quarantine unreadable %s", path)
+		return
+	}
+	logger.WithError(cause).Warnf("Quarantined unreadable %s to %s", path, target)
+}
+
+func (s *fileStore) writeNwConfig(nwKey string, nw *DbNetworkInfo) error {
+	nw.Version = nwSchemaVersion
 	rawData, err := json.Marshal(nw)
 	if err != nil {
 		return err
 	}
 
-	err = mkdirp(persistConfigPath)
+	err = mkdirp(s.dir)
 	if err != nil {
 		return err
 	}
 
-	nwDir := filepath.Join(persistConfigPath, nwKey)
+	nwDir := filepath.Join(s.dir, nwKey)
 	err = mkdirp(nwDir)
 	if err != nil {
 		return err
 	}
 
-	nwFile := filepath.Join(persistConfigPath, nwKey, "config.json")
-	err = ioutil.WriteFile(nwFile, rawData, os.FileMode(0644))
-	return err
+	nwFile := filepath.Join(s.dir, nwKey, "config.json")
+	return writeFileAtomic(nwFile, rawData)
 }
 
-func ReadNwConfigFromDB(nwKey string) (*DbNetworkInfo, error) {
-	nwFile := filepath.Join(persistConfigPath, nwKey, "config.json")
+func (s *fileStore) readNwConfig(nwKey string) (*DbNetworkInfo, error) {
+	nwFile := filepath.Join(s.dir, nwKey, "config.json")
 	_, err := os.Lstat(nwFile)
 	if err != nil {
 		return nil, err
@@ -71,21 +244,24 @@ func ReadNwConfigFromDB(nwKey string) (*DbNetworkInfo, error) {
 	}
 
 	nw := DbNetworkInfo{}
-	err = json.Unmarshal(rawData, &nw)
-	if err != nil {
+	err = decodeRecord(rawData, nwMigrations, &nw)
+	if _, newer := err.(*newerSchemaError); newer {
 		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("Fail to parse %s: %v", nwFile, err)
 	} else {
 		return &nw, nil
 	}
 }
 
-func DeleteNwConfigFromDB(nwKey string) error {
-	nwDir := filepath.Join(persistConfigPath, nwKey)
+func (s *fileStore) deleteNwConfig(nwKey string) error {
+	nwDir := filepath.Join(s.dir, nwKey)
 	os.RemoveAll(nwDir)
 	return nil
 }
 
-func ReadAllNwConfigs(configDir string) (map[string]*DbNetworkInfo, error) {
+func (s *fileStore) readAllNwConfigs() (map[string]*DbNetworkInfo, error) {
+	configDir := s.dir
 	nwList := make(map[string]*DbNetworkInfo)
 
 	_, err := os.Lstat(configDir)
@@ -107,11 +283,151 @@ func ReadAllNwConfigs(configDir string) (map[string]*DbNetworkInfo, error) {
 	}
 
 	for _, info := range nwKeys {
-		nwInfo, err3 := ReadNwConfigFromDB(info.Name())
+		if strings.HasPrefix(info.Name(), ".") || !info.IsDir() {
+			continue
+		}
+		nwInfo, err3 := s.readNwConfig(info.Name())
+		if os.IsNotExist(err3) {
+			// being created or deleted
+			continue
+		}
+		if _, newer := err3.(*newerSchemaError); newer {
+			logger.WithError(err3).WithField(logFieldNetwork, info.Name()).Warn("Skipping network written by a newer plugin")
+			continue
+		}
 		if err3 != nil {
-			return nil, err3
+			// a network whose config is missing or damaged can not be
+			// restored, so its endpoints are set aside with it
+			s.quarantine(filepath.Join(configDir, info.Name()), err3)
+			continue
 		}
 		nwList[info.Name()] = *&nwInfo
 	}
 	return nwList, nil
 }
+
+func (s *fileStore) nwEndpointsDir(nwKey string) string {
+	return filepath.Join(s.dir, nwKey, "endpoints")
+}
+
+func (s *fileStore) writeEndpoint(nwKey string, epKey string, ep *DbEndpointInfo) error {
+	ep.Version = epSchemaVersion
+	rawData, err := json.Marshal(ep)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(filepath.Join(s.dir, nwKey, "config.json"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("network %s is not stored", nwKey)
+	} else if err != nil {
+		return err
+	}
+
+	epDir := s.nwEndpointsDir(nwKey)
+	err = mkdirp(epDir)
+	if err != nil {
+		return err
+	}
+
+	epFile := filepath.Join(epDir, epKey+".json")
+	return writeFileAtomic(epFile, rawData)
+}
+
+func (s *fileStore) deleteEndpoint(nwKey string, epKey string) error {
+	epFile := filepath.Join(s.nwEndpointsDir(nwKey), epKey+".json")
+	err := os.Remove(epFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) readAllEndpoints(nwKey string) (map[string]*DbEndpointInfo, error) {
+	epList := make(map[string]*DbEndpointInfo)
+
+	files, err := ioutil.ReadDir(s.nwEndpointsDir(nwKey))
+	if os.IsNotExist(err) {
+		return epList, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() || filepath.Ext(name) != ".json" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		epFile := filepath.Join(s.nwEndpointsDir(nwKey), name)
+		rawData, err2 := ioutil.ReadFile(epFile)
+		if err2 != nil {
+			return nil, err2
+		}
+		ep := DbEndpointInfo{}
+		err = decodeRecord(rawData, epMigrations, &ep)
+		if _, newer := err.(*newerSchemaError); newer {
+			logger.WithError(err).Warnf("Skipping endpoint %s written by a newer plugin", epFile)
+			continue
+		} else if err != nil {
+			s.quarantine(epFile, err)
+			continue
+		}
+		epList[strings.TrimSuffix(name, ".json")] = &ep
+	}
+	return epList, nil
+}
+
+func (s *fileStore) writeVf(pciAddr string, vf *DbVfInfo) error {
+	vf.Version = vfSchemaVersion
+	rawData, err := json.Marshal(vf)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.dir, vfsDir)
+	err = mkdirp(dir)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, pciAddr+".json"), rawData)
+}
+
+func (s *fileStore) deleteVf(pciAddr string) error {
+	err := os.Remove(filepath.Join(s.dir, vfsDir, pciAddr+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) readAllVfs() (map[string]*DbVfInfo, error) {
+	vfList := make(map[string]*DbVfInfo)
+
+	dir := filepath.Join(s.dir, vfsDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return vfList, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() || filepath.Ext(name) != ".json" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		vfFile := filepath.Join(dir, name)
+		rawData, err := ioutil.ReadFile(vfFile)
+		if err != nil {
+			return nil, err
+		}
+		vf := DbVfInfo{}
+		err = decodeVfRecord(rawData, &vf)
+		if err != nil {
+			s.quarantine(vfFile, err)
+			continue
+		}
+		vfList[strings.TrimSuffix(name, ".json")] = &vf
+	}
+	return vfList, nil
+}
@@ -0,0 +1,184 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/Mellanox/rdmamap"
+	"github.com/k8snetworkplumbingwg/sriovnet"
+	"github.com/vishvananda/netlink"
+)
+
+// Hardware is how the driver accesses PFs and VFs. PFs are named by their
+// netdevice, VFs by their PF and VF index, or by their PCI address for
+// driver binding.
+type Hardware interface {
+	// GetPfNetdevs returns the netdevices of all SR-IOV capable PFs.
+	GetPfNetdevs() ([]string, error)
+	NetdevExists(name string) bool
+	GetNetdevByPciAddress(pciAddr string) (string, error)
+	GetNetdevByMacAddress(macAddr string) (string, error)
+	GetPciAddress(name string) (string, error)
+	GetLinkSpeed(name string) (int, error)
+	GetNumaNode(name string) int
+	// GetCpuListNumaNode returns the NUMA node holding most of the
+	// given cpus, or -1 when none of them belongs to a known node.
+	GetCpuListNumaNode(cpuList string) (int, error)
+	// GetRdmaDevice returns the RDMA device mapped to a netdevice.
+	GetRdmaDevice(name string) (string, error)
+
+	IsSriovEnabled(pfName string) bool
+	GetTotalVfCount(pfName string) (int, error)
+	SetEnabledVfCount(pfName string, vfCount int) error
+	GetPfHandle(pfName string) (*sriovnet.PfNetdevHandle, error)
+
+	GetVfNetdevName(pfName string, vfIndex int) string
+	GetVfMacAddress(pfName string, vfIndex int) (string, error)
+	GetVfInfo(pfName string, vfIndex int) (*netlink.VfInfo, error)
+	// GetVfInfos returns the configuration and counters of all VFs of a PF.
+	GetVfInfos(pfName string) ([]netlink.VfInfo, error)
+	SetVfVlan(pfName string, vfIndex int, vlan int) error
+	SetVfPrivileged(pfName string, vfIndex int, privileged bool) error
+	SetVfRate(pfName string, vfIndex int, minRate int, maxRate int) error
+	ResetVfConfig(pfName string, vfIndex int, mac net.HardwareAddr) error
+
+	GetRoceHopLimit(vfNetdev string) (uint8, error)
+	SetRoceHopLimit(vfNetdev string, hopLimit uint8) error
+
+	// BindVfio rebinds a VF to vfio-pci and returns its previous driver.
+	BindVfio(pciAddr string) (string, error)
+	BindDriver(pciAddr string, driver string) error
+	GetIommuGroup(pciAddr string) (string, error)
+}
+
+// sysfsHardware accesses the NICs of the host through sysfs and netlink.
+type sysfsHardware struct{}
+
+func NewSysfsHardware() Hardware {
+	return &sysfsHardware{}
+}
+
+func vfDirName(vfIndex int) string {
+	return fmt.Sprintf("%s%d", netDevVFDevicePrefix, vfIndex)
+}
+
+func (hw *sysfsHardware) GetPfNetdevs() ([]string, error) {
+	var names []string
+
+	entries, err := ioutil.ReadDir(netSysDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		_, err = os.Stat(filepath.Join(netDevDeviceDir(entry.Name()), netDevTotalVFCountFile))
+		if err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (hw *sysfsHardware) NetdevExists(name string) bool {
+	_, err := os.Stat(filepath.Join(netSysDir, name))
+	return err == nil
+}
+
+func (hw *sysfsHardware) GetNetdevByPciAddress(pciAddr string) (string, error) {
+	return netdevFromPciAddress(pciAddr)
+}
+
+func (hw *sysfsHardware) GetNetdevByMacAddress(macAddr string) (string, error) {
+	return netdevFromMacAddress(macAddr)
+}
+
+func (hw *sysfsHardware) GetPciAddress(name string) (string, error) {
+	return sriovnet.GetPciFromNetDevice(name)
+}
+
+func (hw *sysfsHardware) GetLinkSpeed(name string) (int, error) {
+	return netdevGetLinkSpeed(name)
+}
+
+func (hw *sysfsHardware) GetNumaNode(name string) int {
+	return netdevGetNumaNode(name)
+}
+
+func (hw *sysfsHardware) GetCpuListNumaNode(cpuList string) (int, error) {
+	return cpuListNumaNode(cpuList)
+}
+
+func (hw *sysfsHardware) GetRdmaDevice(name string) (string, error) {
+	return rdmamap.GetRdmaDeviceForNetdevice(name)
+}
+
+func (hw *sysfsHardware) IsSriovEnabled(pfName string) bool {
+	return sriovnet.IsSriovEnabled(pfName)
+}
+
+func (hw *sysfsHardware) GetTotalVfCount(pfName string) (int, error) {
+	return netdevGetTotalVFCount(pfName)
+}
+
+func (hw *sysfsHardware) SetEnabledVfCount(pfName string, vfCount int) error {
+	return netdevSetEnabledVFCount(pfName, vfCount)
+}
+
+func (hw *sysfsHardware) GetPfHandle(pfName string) (*sriovnet.PfNetdevHandle, error) {
+	return sriovnet.GetPfNetdevHandle(pfName)
+}
+
+func (hw *sysfsHardware) GetVfNetdevName(pfName string, vfIndex int) string {
+	handle := sriovnet.PfNetdevHandle{PfNetdevName: pfName}
+	return sriovnet.GetVfNetdevName(&handle, &sriovnet.VfObj{Index: vfIndex})
+}
+
+func (hw *sysfsHardware) GetVfMacAddress(pfName string, vfIndex int) (string, error) {
+	return sriovnet.GetVfDefaultMacAddr(hw.GetVfNetdevName(pfName, vfIndex))
+}
+
+func (hw *sysfsHardware) GetVfInfo(pfName string, vfIndex int) (*netlink.VfInfo, error) {
+	return netdevGetVFInfo(pfName, vfIndex)
+}
+
+func (hw *sysfsHardware) GetVfInfos(pfName string) ([]netlink.VfInfo, error) {
+	return netdevGetVFInfos(pfName)
+}
+
+func (hw *sysfsHardware) SetVfVlan(pfName string, vfIndex int, vlan int) error {
+	return SetVFVlan(pfName, vfDirName(vfIndex), vlan)
+}
+
+func (hw *sysfsHardware) SetVfPrivileged(pfName string, vfIndex int, privileged bool) error {
+	return SetVFPrivileged(pfName, vfDirName(vfIndex), privileged)
+}
+
+func (hw *sysfsHardware) SetVfRate(pfName string, vfIndex int, minRate int, maxRate int) error {
+	return SetVFRate(pfName, vfIndex, minRate, maxRate)
+}
+
+func (hw *sysfsHardware) ResetVfConfig(pfName string, vfIndex int, mac net.HardwareAddr) error {
+	return ResetVFConfig(pfName, vfIndex, mac)
+}
+
+func (hw *sysfsHardware) GetRoceHopLimit(vfNetdev string) (uint8, error) {
+	return getRoceHopLimitWA(vfNetdev)
+}
+
+func (hw *sysfsHardware) SetRoceHopLimit(vfNetdev string, hopLimit uint8) error {
+	return setRoceHopLimitWA(vfNetdev, hopLimit)
+}
+
+func (hw *sysfsHardware) BindVfio(pciAddr string) (string, error) {
+	return pciBindVfio(pciAddr)
+}
+
+func (hw *sysfsHardware) BindDriver(pciAddr string, driver string) error {
+	return pciBindDriver(pciAddr, driver)
+}
+
+func (hw *sysfsHardware) GetIommuGroup(pciAddr string) (string, error) {
+	return pciGetIommuGroup(pciAddr)
+}
@@ -0,0 +1,96 @@
+package driver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	stdlog "log"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+
+	logFormatText = "text" // logfmt
+	logFormatJSON = "json"
+)
+
+// fields of log records, so that the records of one network, endpoint or
+// VF can be picked out
+const (
+	logFieldRequest  = "request" // correlation ID of a plugin call
+	logFieldMethod   = "method"
+	logFieldNetwork  = "network"
+	logFieldEndpoint = "endpoint"
+	logFieldPf       = "pf"
+	logFieldVf       = "vf"
+)
+
+var logLevels = map[string]logrus.Level{
+	logLevelDebug: logrus.DebugLevel,
+	logLevelInfo:  logrus.InfoLevel,
+	logLevelWarn:  logrus.WarnLevel,
+	logLevelError: logrus.ErrorLevel,
+}
+
+// logger is the logger of the plugin. Records of a plugin call are logged
+// through the entry of the call, see requestLogger.
+var logger = logrus.StandardLogger()
+
+func init() {
+	SetLogFormat(logFormatText)
+	// libraries logging through the standard logger end up in the same
+	// stream
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(logger.WriterLevel(logrus.InfoLevel))
+}
+
+// SetLogLevel sets the verbosity of the plugin log. Debug also logs every
+// request of Docker.
+func SetLogLevel(level string) {
+	if logLevel, ok := logLevels[level]; ok {
+		logger.SetLevel(logLevel)
+	}
+}
+
+// SetLogFormat sets the format of the plugin log, logfmt text or JSON.
+func SetLogFormat(format string) {
+	if format == logFormatJSON {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+		return
+	}
+	logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+}
+
+// requestLogger returns the entry of a plugin call, whose records carry a
+// new correlation ID along with the network and endpoint of the call.
+func requestLogger(method string, nid string, eid string) *logrus.Entry {
+	fields := logrus.Fields{
+		logFieldRequest: newRequestID(),
+		logFieldMethod:  method,
+	}
+	if nid != "" {
+		fields[logFieldNetwork] = nid
+	}
+	if eid != "" {
+		fields[logFieldEndpoint] = eid
+	}
+	return logger.WithFields(fields)
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// vfLogger adds the PF and VF index of an endpoint to the records of log.
+func vfLogger(log *logrus.Entry, pfNetdevName string, vfIndex int) *logrus.Entry {
+	return log.WithFields(logrus.Fields{logFieldPf: pfNetdevName, logFieldVf: vfIndex})
+}
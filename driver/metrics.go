@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "sriov_plugin"
+
+var (
+	pfVfsDesc = prometheus.NewDesc(metricsNamespace+"_pf_vfs",
+		"VFs enabled on a PF used by sriov networks.", []string{"pf"}, nil)
+	pfVfsAllocatedDesc = prometheus.NewDesc(metricsNamespace+"_pf_vfs_allocated",
+		"VFs of a PF allocated to endpoints or quarantined.", []string{"pf"}, nil)
+	pfVfsQuarantinedDesc = prometheus.NewDesc(metricsNamespace+"_pf_vfs_quarantined",
+		"VFs of a PF which could not be reset on release.", []string{"pf"}, nil)
+	pfNetworksDesc = prometheus.NewDesc(metricsNamespace+"_pf_networks",
+		"Networks using a PF.", []string{"pf"}, nil)
+	networksDesc = prometheus.NewDesc(metricsNamespace+"_networks",
+		"Networks of the plugin by mode.", []string{"mode"}, nil)
+
+	vfRxBytesDesc = prometheus.NewDesc(metricsNamespace+"_vf_receive_bytes_total",
+		"Bytes received by a VF.", []string{"pf", "vf"}, nil)
+	vfTxBytesDesc = prometheus.NewDesc(metricsNamespace+"_vf_transmit_bytes_total",
+		"Bytes transmitted by a VF.", []string{"pf", "vf"}, nil)
+	vfRxPacketsDesc = prometheus.NewDesc(metricsNamespace+"_vf_receive_packets_total",
+		"Packets received by a VF.", []string{"pf", "vf"}, nil)
+	vfTxPacketsDesc = prometheus.NewDesc(metricsNamespace+"_vf_transmit_packets_total",
+		"Packets transmitted by a VF.", []string{"pf", "vf"}, nil)
+)
+
+// metrics are the Prometheus metrics of a driver. Counters are updated as
+// requests are handled, the state of networks and PFs is read on scrape.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requestDuration *prometheus.HistogramVec
+	requestErrors   *prometheus.CounterVec
+	vfAllocFailures *prometheus.CounterVec
+}
+
+func newMetrics(d *driver) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken by the plugin calls of Docker, by method.",
+			Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+		}, []string{"method"}),
+		requestErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_errors_total",
+			Help:      "Plugin calls of Docker which failed, by method.",
+		}, []string{"method"}),
+		vfAllocFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "vf_allocation_failures_total",
+			Help:      "Endpoints which got no VF of a network, such as when all are allocated.",
+		}, []string{"network"}),
+	}
+
+	m.registry.MustRegister(
+		m.requestDuration,
+		m.requestErrors,
+		m.vfAllocFailures,
+		&driverCollector{d: d},
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observeRequest records a plugin call which started at start and failed
+// when *err is set, to be deferred by the handler of the call.
+func (m *metrics) observeRequest(method string, start time.Time, err *error) {
+	m.requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		m.requestErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// driverCollector collects the VF pool of each PF, the networks by mode
+// and the counters of each VF when scraped.
+type driverCollector struct {
+	d *driver
+}
+
+func (c *driverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pfVfsDesc
+	ch <- pfVfsAllocatedDesc
+	ch <- pfVfsQuarantinedDesc
+	ch <- pfNetworksDesc
+	ch <- networksDesc
+	ch <- vfRxBytesDesc
+	ch <- vfTxBytesDesc
+	ch <- vfRxPacketsDesc
+	ch <- vfTxPacketsDesc
+}
+
+func (c *driverCollector) Collect(ch chan<- prometheus.Metric) {
+	d := c.d
+	var pfNames []string
+	modes := map[string]int{networkModePT: 0, networkModeSRIOV: 0}
+
+	d.RLock()
+	for _, nw := range d.networks {
+		modes[nw.getGenNw().mode]++
+	}
+	for name, dev := range d.pfDevices {
+		pfNames = append(pfNames, name)
+
+		dev.lock.Lock()
+		allocated := 0
+		for _, vf := range dev.pfHandle.List {
+			if vf.Allocated {
+				allocated++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(pfVfsDesc, prometheus.GaugeValue, float64(len(dev.pfHandle.List)), name)
+		ch <- prometheus.MustNewConstMetric(pfVfsAllocatedDesc, prometheus.GaugeValue, float64(allocated), name)
+		ch <- prometheus.MustNewConstMetric(pfVfsQuarantinedDesc, prometheus.GaugeValue, float64(len(dev.quarantinedVfs)), name)
+		dev.lock.Unlock()
+		ch <- prometheus.MustNewConstMetric(pfNetworksDesc, prometheus.GaugeValue, float64(dev.nwUseRefCount), name)
+	}
+	d.RUnlock()
+
+	for mode, count := range modes {
+		ch <- prometheus.MustNewConstMetric(networksDesc, prometheus.GaugeValue, float64(count), mode)
+	}
+
+	// the counters are read from the PFs without holding the locks
+	for _, name := range pfNames {
+		infos, err := d.hw.GetVfInfos(name)
+		if err != nil {
+			logger.WithError(err).WithField(logFieldPf, name).Warn("Fail to read VF counters")
+			continue
+		}
+		for _, info := range infos {
+			vf := strconv.Itoa(info.ID)
+			ch <- prometheus.MustNewConstMetric(vfRxBytesDesc, prometheus.CounterValue, float64(info.RxBytes), name, vf)
+			ch <- prometheus.MustNewConstMetric(vfTxBytesDesc, prometheus.CounterValue, float64(info.TxBytes), name, vf)
+			ch <- prometheus.MustNewConstMetric(vfRxPacketsDesc, prometheus.CounterValue, float64(info.RxPackets), name, vf)
+			ch <- prometheus.MustNewConstMetric(vfTxPacketsDesc, prometheus.CounterValue, float64(info.TxPackets), name, vf)
+		}
+	}
+}
+
+// NewMetricsServer returns a server serving the metrics of a driver on
+// /metrics of a TCP address.
+func NewMetricsServer(d *driver, address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.metrics.handler())
+	return &http.Server{Addr: address, Handler: mux}
+}
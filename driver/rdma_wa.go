@@ -1,20 +1,43 @@
 package driver
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/Mellanox/rdmamap"
 )
 
-func setRoceHopLimitWA(netdevice string, hopLimit uint8) error {
+func roceHopLimitFile(netdevice string) (string, error) {
 	rdmadev, err := rdmamap.GetRdmaDeviceForNetdevice(netdevice)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	return filepath.Join(rdmamap.RdmaClassDir, rdmadev, "ttl", "1", "ttl"), nil
+}
+
+func getRoceHopLimitWA(netdevice string) (uint8, error) {
+	file, err := roceHopLimitFile(netdevice)
+	if err != nil {
+		return 0, err
 	}
 
-	file := filepath.Join(rdmamap.RdmaClassDir, rdmadev, "ttl", "1", "ttl")
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 8)
+	return uint8(value), err
+}
+
+func setRoceHopLimitWA(netdevice string, hopLimit uint8) error {
+	file, err := roceHopLimitFile(netdevice)
+	if err != nil {
+		return err
+	}
 
 	ttlFile, err := os.OpenFile(file, os.O_WRONLY, 0444)
 	if err != nil {
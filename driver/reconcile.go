@@ -0,0 +1,196 @@
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReconcileInterval = time.Minute
+
+	// Networks and endpoints are created before Docker lists them, so
+	// younger ones are never taken for stale ones.
+	reconcileGracePeriod = 2 * time.Minute
+
+	defaultDockerRetryInterval = 5 * time.Second
+)
+
+// dockerLookup looks up the networks and endpoints Docker has, which the
+// driver is reconciled with.
+type dockerLookup interface {
+	GetNetworkList() (map[string]types.NetworkResource, error)
+	GetNetworkEndpoints(networkID string) (map[string]bool, error)
+}
+
+// dockerAPI looks them up through the Docker API.
+type dockerAPI struct{}
+
+func (dockerAPI) GetNetworkList() (map[string]types.NetworkResource, error) {
+	return GetNetworkList()
+}
+
+func (dockerAPI) GetNetworkEndpoints(networkID string) (map[string]bool, error) {
+	return GetNetworkEndpoints(networkID)
+}
+
+// Reconcile brings the driver in line with the networks and endpoints
+// known to Docker. Networks Docker no longer has are deleted, and
+// endpoints it no longer has on a network have their VFs released. These
+// are left behind when the plugin is down while Docker deletes them, or
+// when a container goes away without a Leave. The records of a pass share
+// a correlation ID.
+func (d *driver) Reconcile() error {
+	log := requestLogger("Reconcile", "", "")
+
+	var nwList map[string]*DbNetworkInfo
+	err := d.store.View(func(tx StoreTx) error {
+		var err error
+		nwList, err = tx.Networks()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	validNetworks, err := d.docker.GetNetworkList()
+	if err != nil {
+		return err
+	}
+
+	d.RLock()
+	networkIDs := d.networkIDs()
+	d.RUnlock()
+
+	// endpoint IDs Docker has on the networks of the driver
+	dockerEndpoints := make(map[string]map[string]bool)
+	for _, id := range networkIDs {
+		if _, valid := validNetworks[id]; !valid {
+			continue
+		}
+		endpoints, err := d.docker.GetNetworkEndpoints(id)
+		if err != nil {
+			return err
+		}
+		dockerEndpoints[id] = endpoints
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for id := range nwList {
+		_, valid := validNetworks[id]
+		if valid {
+			continue
+		}
+		nw := d.getNetwork(id)
+		if nw != nil && time.Since(nw.getGenNw().created) < reconcileGracePeriod {
+			continue
+		}
+		nwLog := log.WithField(logFieldNetwork, id)
+		nwLog.Info("Deleting stale network")
+		d.deleteNetwork(nwLog, &network.DeleteNetworkRequest{NetworkID: id})
+	}
+
+	for id, endpoints := range dockerEndpoints {
+		d.releaseLeakedEndpoints(log.WithField(logFieldNetwork, id), id, endpoints)
+	}
+	return nil
+}
+
+// releaseLeakedEndpoints releases the endpoints of a network which Docker
+// does not have. It must be called with the driver lock held for writing.
+func (d *driver) releaseLeakedEndpoints(log *logrus.Entry, nid string, dockerEndpoints map[string]bool) {
+	nw := d.getNetwork(nid)
+	if nw == nil {
+		return
+	}
+	genNw := nw.getGenNw()
+
+	var leaked []*ptEndpoint
+	genNw.lock.Lock()
+	for id, endpoint := range genNw.ndevEndpoints {
+		if dockerEndpoints[id] || time.Since(endpoint.created) < reconcileGracePeriod {
+			continue
+		}
+		leaked = append(leaked, endpoint)
+		delete(genNw.ndevEndpoints, id)
+	}
+	genNw.lock.Unlock()
+
+	releaseErrs := make([]error, len(leaked))
+	for i, endpoint := range leaked {
+		epLog := log.WithFields(logrus.Fields{logFieldEndpoint: endpoint.id, "sandbox": endpoint.sandboxKey})
+		epLog.Info("Releasing endpoint unknown to Docker")
+		releaseErrs[i] = nw.DeleteEndpoint(epLog, endpoint)
+	}
+
+	err := d.store.Update(func(tx StoreTx) error {
+		for i, endpoint := range leaked {
+			err := tx.DeleteEndpoint(nid, endpoint.id)
+			if err == nil {
+				err = storeVfRelease(tx, nid, endpoint, releaseErrs[i])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to delete stored endpoints")
+	}
+}
+
+// TriggerReconcile makes the reconciler run a pass now.
+func (d *driver) TriggerReconcile() {
+	select {
+	case d.reconcileTrigger <- struct{}{}:
+	default:
+		// a pass is already pending
+	}
+}
+
+// runReconciler reconciles with Docker at the reconcile interval, when
+// Docker reports a network or endpoint going away, and when triggered.
+// Until Docker is reachable it retries at the retry interval.
+func (d *driver) runReconciler() {
+	go d.watchDockerEvents()
+
+	for {
+		wait, retryInterval := d.reconcileIntervals()
+		err := d.Reconcile()
+		if err != nil {
+			logger.WithError(err).Warn("Fail to reconcile with Docker")
+			wait = retryInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.reconcileTrigger:
+			timer.Stop()
+		}
+	}
+}
+
+func (d *driver) watchDockerEvents() {
+	for {
+		err := WatchNetworkEvents(context.Background(), func(msg events.Message) {
+			switch msg.Action {
+			case "destroy", "disconnect":
+				d.TriggerReconcile()
+			}
+		})
+		logger.WithError(err).Warn("Docker event stream closed")
+		_, retryInterval := d.reconcileIntervals()
+		time.Sleep(retryInterval)
+
+		// events may have been missed meanwhile
+		d.TriggerReconcile()
+	}
+}
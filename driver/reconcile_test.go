@@ -0,0 +1,158 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/internal/fakehw"
+	"github.com/docker/docker/api/types"
+)
+
+// fakeDocker has the networks it holds endpoints of.
+type fakeDocker struct {
+	endpoints map[string]map[string]bool
+	err       error
+}
+
+func (f *fakeDocker) GetNetworkList() (map[string]types.NetworkResource, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	networks := make(map[string]types.NetworkResource)
+	for id := range f.endpoints {
+		networks[id] = types.NetworkResource{ID: id}
+	}
+	return networks, nil
+}
+
+func (f *fakeDocker) GetNetworkEndpoints(networkID string) (map[string]bool, error) {
+	return f.endpoints[networkID], f.err
+}
+
+// startReconcileTest starts a driver with a network on a PF with 4 VFs,
+// and an endpoint on it.
+func startReconcileTest(t *testing.T) (*fakehw.Hardware, *driver, *fakeDocker) {
+	hw := fakehw.New()
+	hw.AddPf("ens1f0", 8, 4)
+	d := startTestDriver(t, hw, testConfig(t))
+	docker := &fakeDocker{endpoints: make(map[string]map[string]bool)}
+	d.docker = docker
+	log := testLog(t)
+
+	err := d.CreateNetwork(log, createNetworkRequest(testNetworkID, map[string]interface{}{"netdevice": "ens1f0"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	_, err = d.CreateEndpoint(log, createEndpointRequest(testNetworkID, testEndpointID, nil))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	return hw, d, docker
+}
+
+// ageNetwork makes a network and its endpoints older than the grace
+// period.
+func ageNetwork(d *driver, nid string) {
+	genNw := d.getNetwork(nid).getGenNw()
+	genNw.lock.Lock()
+	defer genNw.lock.Unlock()
+	genNw.created = time.Now().Add(-reconcileGracePeriod)
+	for _, endpoint := range genNw.ndevEndpoints {
+		endpoint.created = genNw.created
+	}
+}
+
+func TestReconcileGracePeriod(t *testing.T) {
+	_, d, docker := startReconcileTest(t)
+
+	docker.err = errDeviceBusy
+	if d.Reconcile() == nil {
+		t.Errorf("Reconcile succeeded without Docker")
+	}
+	docker.err = nil
+	err := d.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if d.getNetwork(testNetworkID) == nil {
+		t.Fatalf("network deleted within the grace period")
+	}
+
+	docker.endpoints[testNetworkID] = map[string]bool{}
+	err = d.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if getEndpoint(d.getNetwork(testNetworkID).getGenNw(), testEndpointID) == nil {
+		t.Errorf("endpoint released within the grace period")
+	}
+	if d.getPfDevice("ens1f0").freeVfCount() != 3 {
+		t.Errorf("%d VFs free, expected 3", d.getPfDevice("ens1f0").freeVfCount())
+	}
+}
+
+func TestReconcileReleaseLeakedEndpoints(t *testing.T) {
+	_, d, docker := startReconcileTest(t)
+	_, err := d.CreateEndpoint(testLog(t), createEndpointRequest(testNetworkID, "running", nil))
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	ageNetwork(d, testNetworkID)
+
+	docker.endpoints[testNetworkID] = map[string]bool{"running": true}
+	err = d.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	genNw := d.getNetwork(testNetworkID).getGenNw()
+	if getEndpoint(genNw, testEndpointID) != nil || getEndpoint(genNw, "running") == nil {
+		t.Errorf("endpoints after Reconcile are %v, expected running", genNw.ndevEndpoints)
+	}
+	if d.getPfDevice("ens1f0").freeVfCount() != 3 {
+		t.Errorf("%d VFs free, expected 3", d.getPfDevice("ens1f0").freeVfCount())
+	}
+	if epList := storedEndpoints(t, d, testNetworkID); len(epList) != 1 || epList["running"] == nil {
+		t.Errorf("stored endpoints are %v, expected running", epList)
+	}
+	if vfList := storedVfs(t, d); len(vfList) != 1 {
+		t.Errorf("stored VFs are %v, expected the one of running", vfList)
+	}
+}
+
+func TestReconcileDeleteStaleNetwork(t *testing.T) {
+	hw, d, _ := startReconcileTest(t)
+	hw.AddPf("ens2f0", 8, 0)
+	err := d.CreateNetwork(testLog(t), createNetworkRequest("numvfs"+testNetworkID[6:],
+		map[string]interface{}{"netdevice": "ens2f0", "numvfs": "2"}))
+	if err != nil {
+		t.Fatalf("CreateNetwork: %v", err)
+	}
+	ageNetwork(d, testNetworkID)
+	ageNetwork(d, "numvfs"+testNetworkID[6:])
+
+	err = d.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(d.networks) != 0 || len(d.pfDevices) != 0 {
+		t.Errorf("networks %v and PFs %v left after Reconcile", d.networks, d.pfDevices)
+	}
+	if hw.IsSriovEnabled("ens2f0") {
+		t.Errorf("SR-IOV enabled through numvfs still on")
+	}
+	var nwList map[string]*DbNetworkInfo
+	err = d.store.View(func(tx StoreTx) error {
+		var err error
+		nwList, err = tx.Networks()
+		return err
+	})
+	if err != nil || len(nwList) != 0 {
+		t.Errorf("stored networks are %v, %v", nwList, err)
+	}
+	if vfList := storedVfs(t, d); len(vfList) != 0 {
+		t.Errorf("stored VFs are %v after Reconcile", vfList)
+	}
+	if !hw.IsSriovEnabled("ens1f0") {
+		t.Errorf("SR-IOV enabled by the administrator was disabled")
+	}
+}
@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// The registry of networks and the PFs they use. Networks are added and
+// removed with the driver lock held for writing, and looked up with it
+// held for reading at least.
+
+func (d *driver) getNetwork(nid string) NwIface {
+	return d.networks[nid]
+}
+
+func (d *driver) networkIDs() []string {
+	var ids []string
+	for nid := range d.networks {
+		ids = append(ids, nid)
+	}
+	return ids
+}
+
+// addNetwork registers a created network and takes a reference on each of
+// its PFs.
+func (d *driver) addNetwork(nid string, nw NwIface) {
+	d.networks[nid] = nw
+
+	for _, pfNetdevName := range networkPfNames(nw) {
+		d.pfDevices[pfNetdevName].nwUseRefCount++
+	}
+}
+
+// removeNetwork unregisters a network and drops its references on its
+// PFs. PFs no longer used by any network are released.
+func (d *driver) removeNetwork(log *logrus.Entry, nid string) {
+	nw := d.networks[nid]
+	if nw == nil {
+		return
+	}
+	delete(d.networks, nid)
+
+	for _, pfNetdevName := range networkPfNames(nw) {
+		dev := d.pfDevices[pfNetdevName]
+		dev.nwUseRefCount--
+
+		// multiple vlan based network will share enabled VFs.
+		// So first created network enables SRIOV and
+		// Last network that gets deleted, disables SRIOV.
+		if dev.nwUseRefCount == 0 {
+			d.releasePfDevice(log, pfNetdevName)
+		}
+	}
+	log.Infof("Removed network, total networks = %d", len(d.networks))
+}
+
+// networkPfNames returns the PFs a network holds references on.
+func networkPfNames(nw NwIface) []string {
+	if sriovNw, ok := nw.(*sriovNetwork); ok {
+		return sriovNw.pfNames
+	}
+	return nil
+}
+
+// vlanInUse reports whether a network uses the vlan on any of the PFs.
+func (d *driver) vlanInUse(pfNetdevNames []string, vlan int) bool {
+	if vlan == 0 {
+		return false
+	}
+
+	for _, nw := range d.networks {
+		sriovNw, ok := nw.(*sriovNetwork)
+		if !ok || sriovNw.vlan != vlan {
+			continue
+		}
+		for _, pfNetdevName := range pfNetdevNames {
+			if sriovNw.usesPf(pfNetdevName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *driver) getPfDevice(pfNetdevName string) *pfDevice {
+	return d.pfDevices[pfNetdevName]
+}
+
+func (d *driver) addPfDevice(pfNetdevName string, dev *pfDevice) {
+	d.pfDevices[pfNetdevName] = dev
+}
+
+// releasePfDevice forgets a PF which is no longer used by any network,
+// disabling SR-IOV on it if the plugin enabled it.
+func (d *driver) releasePfDevice(log *logrus.Entry, pfNetdevName string) {
+	dev := d.pfDevices[pfNetdevName]
+	if dev.enabledByPlugin {
+		log = log.WithField(logFieldPf, pfNetdevName)
+		log.Info("Disabling sriov")
+		err := d.hw.SetEnabledVfCount(pfNetdevName, 0)
+		if err != nil {
+			log.WithError(err).Error("Fail to disable sriov")
+		}
+	}
+	delete(d.pfDevices, pfNetdevName)
+}
@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// migration upgrades a decoded record by one schema version.
+type migration func(record map[string]interface{}) error
+
+// nwMigrations[v] upgrades a network config.json from version v to v+1.
+// Files written before versioning have version 0. Register a migration
+// here whenever DbNetworkInfo changes in a way old files do not decode to.
+var nwMigrations = []migration{
+	// 1: fields are named like those of DbNetworkInfo
+	func(record map[string]interface{}) error {
+		renameField(record, "Netdevice", "Netdev")
+		renameField(record, "vlan", "Vlan")
+		return nil
+	},
+}
+
+// epMigrations[v] upgrades an endpoint ep-N.json from version v to v+1.
+var epMigrations = []migration{
+	// 1: only stamps the version
+	nil,
+}
+
+// vfMigrations[v] upgrades a VF record from version v to v+1.
+var vfMigrations = []migration{}
+
+// schema versions the binary writes and understands
+var (
+	nwSchemaVersion = uint32(len(nwMigrations))
+	epSchemaVersion = uint32(len(epMigrations))
+	vfSchemaVersion = uint32(len(vfMigrations))
+)
+
+// newerSchemaError is returned for records written by a newer binary,
+// which are left alone instead of being misread.
+type newerSchemaError struct {
+	version uint32
+	current uint32
+}
+
+func (e *newerSchemaError) Error() string {
+	return fmt.Sprintf("schema version %d is newer than the supported version %d", e.version, e.current)
+}
+
+func renameField(record map[string]interface{}, from string, to string) {
+	value, ok := record[from]
+	if !ok {
+		return
+	}
+	delete(record, from)
+	if _, exists := record[to]; !exists {
+		record[to] = value
+	}
+}
+
+// decodeRecord decodes a persisted record into out, running the
+// migrations from the version it was written with.
+func decodeRecord(rawData []byte, migrations []migration, out interface{}) error {
+	record := make(map[string]interface{})
+	err := json.Unmarshal(rawData, &record)
+	if err != nil {
+		return err
+	}
+
+	current := uint32(len(migrations))
+	version := uint32(0)
+	if value, ok := record["Version"].(float64); ok {
+		version = uint32(value)
+	}
+	if version > current {
+		return &newerSchemaError{version: version, current: current}
+	}
+
+	for ; version < current; version++ {
+		migrate := migrations[version]
+		if migrate == nil {
+			continue
+		}
+		err = migrate(record)
+		if err != nil {
+			return fmt.Errorf("Fail to migrate to schema version %d: %v", version+1, err)
+		}
+	}
+	record["Version"] = current
+
+	rawData, err = json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rawData, out)
+}
+
+// decodeVfRecord decodes a VF record. Records written by a newer plugin
+// are read with the fields this one knows, as their VFs have to stay
+// allocated all the same.
+func decodeVfRecord(rawData []byte, vf *DbVfInfo) error {
+	err := decodeRecord(rawData, vfMigrations, vf)
+	if _, newer := err.(*newerSchemaError); newer {
+		return json.Unmarshal(rawData, vf)
+	}
+	return err
+}
@@ -0,0 +1,287 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/sirupsen/logrus"
+)
+
+// directory Docker looks for plugin sockets in
+const pluginSockDir = "/run/docker/plugins"
+
+// Server serves a driver on its plugin socket and shuts it down
+// gracefully. The handler of go-plugins-helpers cannot be shut down, so
+// requests in flight are tracked in front of the driver instead, along
+// with the time taken and errors of each call.
+type Server struct {
+	d      *driver
+	socket string
+	l      net.Listener
+
+	lock     sync.Mutex
+	closing  bool
+	inFlight sync.WaitGroup
+	done     chan struct{}
+}
+
+// NewServer creates a server for a driver. The socket is a plugin name,
+// served in the plugin directory of Docker, or an absolute path.
+func NewServer(d *driver, socket string) *Server {
+	if !filepath.IsAbs(socket) {
+		socket = filepath.Join(pluginSockDir, socket+".sock")
+	}
+	return &Server{
+		d:      d,
+		socket: socket,
+		done:   make(chan struct{}),
+	}
+}
+
+// Serve serves requests until the server is shut down, and returns once
+// the shutdown is complete.
+func (s *Server) Serve() error {
+	err := os.MkdirAll(filepath.Dir(s.socket), 0755)
+	if err != nil {
+		return err
+	}
+	l, err := sockets.NewUnixSocket(s.socket, 0)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		l.Close()
+		return nil
+	}
+	s.l = l
+	s.lock.Unlock()
+
+	err = network.NewHandler(s).Serve(l)
+
+	s.lock.Lock()
+	closing := s.closing
+	s.lock.Unlock()
+	if !closing {
+		return err
+	}
+	<-s.done
+	return nil
+}
+
+// Shutdown stops accepting requests, waits up to timeout for those in
+// flight, persists the state of all endpoints, closes the store and
+// removes the socket.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return fmt.Errorf("shutdown already in progress")
+	}
+	s.closing = true
+	if s.l != nil {
+		s.l.Close()
+	}
+	s.lock.Unlock()
+	defer close(s.done)
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		logger.Info("All requests in flight completed")
+	case <-time.After(timeout):
+		err = fmt.Errorf("requests still in flight after %v", timeout)
+	}
+
+	persistErr := s.d.persistEndpoints()
+	if err == nil {
+		err = persistErr
+	}
+	closeErr := s.d.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	rmErr := os.Remove(s.socket)
+	if rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// enter registers a request in flight, unless the server is shutting down.
+func (s *Server) enter() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closing {
+		return fmt.Errorf("plugin is shutting down")
+	}
+	s.inFlight.Add(1)
+	return nil
+}
+
+// finish records a plugin call which started at start in the metrics, and
+// logs it when it failed.
+func (s *Server) finish(log *logrus.Entry, method string, start time.Time, err *error) {
+	s.d.metrics.observeRequest(method, start, err)
+	if *err != nil {
+		log.WithError(*err).Warn("Request failed")
+		return
+	}
+	log.WithField("duration", time.Since(start)).Debug("Request completed")
+}
+
+func (s *Server) GetCapabilities() (resp *network.CapabilitiesResponse, err error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("GetCapabilities", "", "")
+	defer s.finish(log, "GetCapabilities", time.Now(), &err)
+	return s.d.GetCapabilities(log)
+}
+
+func (s *Server) CreateNetwork(r *network.CreateNetworkRequest) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("CreateNetwork", r.NetworkID, "")
+	defer s.finish(log, "CreateNetwork", time.Now(), &err)
+	return s.d.CreateNetwork(log, r)
+}
+
+func (s *Server) AllocateNetwork(r *network.AllocateNetworkRequest) (resp *network.AllocateNetworkResponse, err error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("AllocateNetwork", r.NetworkID, "")
+	defer s.finish(log, "AllocateNetwork", time.Now(), &err)
+	return s.d.AllocateNetwork(log, r)
+}
+
+func (s *Server) DeleteNetwork(r *network.DeleteNetworkRequest) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("DeleteNetwork", r.NetworkID, "")
+	defer s.finish(log, "DeleteNetwork", time.Now(), &err)
+	return s.d.DeleteNetwork(log, r)
+}
+
+func (s *Server) FreeNetwork(r *network.FreeNetworkRequest) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("FreeNetwork", r.NetworkID, "")
+	defer s.finish(log, "FreeNetwork", time.Now(), &err)
+	return s.d.FreeNetwork(log, r)
+}
+
+func (s *Server) CreateEndpoint(r *network.CreateEndpointRequest) (resp *network.CreateEndpointResponse, err error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("CreateEndpoint", r.NetworkID, r.EndpointID)
+	defer s.finish(log, "CreateEndpoint", time.Now(), &err)
+	return s.d.CreateEndpoint(log, r)
+}
+
+func (s *Server) DeleteEndpoint(r *network.DeleteEndpointRequest) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("DeleteEndpoint", r.NetworkID, r.EndpointID)
+	defer s.finish(log, "DeleteEndpoint", time.Now(), &err)
+	return s.d.DeleteEndpoint(log, r)
+}
+
+func (s *Server) EndpointInfo(r *network.InfoRequest) (resp *network.InfoResponse, err error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("EndpointInfo", r.NetworkID, r.EndpointID)
+	defer s.finish(log, "EndpointInfo", time.Now(), &err)
+	return s.d.EndpointInfo(log, r)
+}
+
+func (s *Server) Join(r *network.JoinRequest) (resp *network.JoinResponse, err error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("Join", r.NetworkID, r.EndpointID)
+	defer s.finish(log, "Join", time.Now(), &err)
+	return s.d.Join(log, r)
+}
+
+func (s *Server) Leave(r *network.LeaveRequest) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("Leave", r.NetworkID, r.EndpointID)
+	defer s.finish(log, "Leave", time.Now(), &err)
+	return s.d.Leave(log, r)
+}
+
+func (s *Server) DiscoverNew(r *network.DiscoveryNotification) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("DiscoverNew", "", "")
+	defer s.finish(log, "DiscoverNew", time.Now(), &err)
+	return s.d.DiscoverNew(log, r)
+}
+
+func (s *Server) DiscoverDelete(r *network.DiscoveryNotification) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("DiscoverDelete", "", "")
+	defer s.finish(log, "DiscoverDelete", time.Now(), &err)
+	return s.d.DiscoverDelete(log, r)
+}
+
+func (s *Server) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("ProgramExternalConnectivity", r.NetworkID, r.EndpointID)
+	defer s.finish(log, "ProgramExternalConnectivity", time.Now(), &err)
+	return s.d.ProgramExternalConnectivity(log, r)
+}
+
+func (s *Server) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.inFlight.Done()
+	log := requestLogger("RevokeExternalConnectivity", r.NetworkID, r.EndpointID)
+	defer s.finish(log, "RevokeExternalConnectivity", time.Now(), &err)
+	return s.d.RevokeExternalConnectivity(log, r)
+}
@@ -2,11 +2,17 @@ package driver
 
 import (
 	"fmt"
-	"log"
+	"net"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/k8snetworkplumbingwg/sriovnet"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -15,61 +21,153 @@ const (
 	sriovUnsupported = "unsupported"
 )
 
+// VF allocation strategies of networks spanning multiple PFs
+const (
+	allocPack       = "pack"        // fill up PFs in the given order
+	allocRoundRobin = "round-robin" // rotate between PFs
+	allocLeastUsed  = "least-used"  // PF with the most free VFs
+)
+
 type pfDevice struct {
+	// protects the allocation of VFs, which networks sharing the PF
+	// do in parallel
+	lock sync.Mutex
+
 	pfHandle      *sriovnet.PfNetdevHandle
 	state         string
 	nwUseRefCount int
+	numaNode      int
+
+	// SR-IOV was enabled by the plugin through the numvfs option,
+	// so it is disabled again when the last network goes away.
+	enabledByPlugin bool
+
+	// VFs which could not be reset on release, by VF index.
+	// They stay allocated so that no container gets them again.
+	quarantinedVfs map[int]string
 }
 
 type sriovNetwork struct {
 	genNw        *genericNetwork
+	pfNames      []string
+	allocation   string
+	nextPf       int // protected by genNw.lock
 	vlan         int
 	privileged   int
 	roceHopLimit uint8
-}
+	minTxRate    int
+	maxTxRate    int
 
-// nid to network map
-// key = nid
-// value = sriovNetwork
-var networks map[string]*sriovNetwork
+	// PFs which had SR-IOV enabled by the plugin when the network was created
+	sriovOwners []string
 
-// netdevice to sriovstate map
-// key = phy netdevice
-// value = its sriov state/information
-var pfDevices map[string]*pfDevice
-
-func checkVlanNwExist(pfNetdevName string, vlan int) bool {
-	if vlan == 0 {
-		return false
-	}
+	// driver VFs are bound to, empty for the kernel netdevice driver
+	vfDriver string
+}
 
-	for _, nw := range networks {
-		if nw.vlan == vlan && nw.genNw.ndevName == pfNetdevName {
+func (nw *sriovNetwork) usesPf(pfNetdevName string) bool {
+	for _, name := range nw.pfNames {
+		if name == pfNetdevName {
 			return true
 		}
 	}
 	return false
 }
 
+// resolvePfNames expands the netdevice option of a network, which is a
+// comma separated list of PF netdevices or glob patterns.
+func resolvePfNames(hw Hardware, netdevices string) ([]string, error) {
+	var pfNames []string
+	var allPfNames []string
+
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(netdevices, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		names := []string{item}
+		if strings.ContainsAny(item, "*?[") {
+			if allPfNames == nil {
+				var err error
+				// only PFs, VF netdevices often match the same pattern
+				allPfNames, err = hw.GetPfNetdevs()
+				if err != nil {
+					return nil, err
+				}
+			}
+			names = nil
+			for _, name := range allPfNames {
+				matched, err := filepath.Match(item, name)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid netdevice pattern %s: %v", item, err)
+				}
+				if matched {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+		}
+
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				pfNames = append(pfNames, name)
+			}
+		}
+	}
+
+	if len(pfNames) == 0 {
+		return nil, fmt.Errorf("no PF netdevice matches %s", netdevices)
+	}
+	return pfNames, nil
+}
+
 func (nw *sriovNetwork) getGenNw() *genericNetwork {
 	return nw.genNw
 }
 
-func (nw *sriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
+func (nw *sriovNetwork) hw() Hardware {
+	return nw.genNw.driver.hw
+}
+
+func (nw *sriovNetwork) pfDevice(pfNetdevName string) *pfDevice {
+	return nw.genNw.driver.getPfDevice(pfNetdevName)
+}
+
+func (nw *sriovNetwork) CreateNetwork(log *logrus.Entry, d *driver, genNw *genericNetwork,
 	nid string, options map[string]string,
-	ipv4Data *network.IPAMData) error {
+	ipv4Data *network.IPAMData, ipv6Data *network.IPAMData) error {
 	var err error
 	var vlan int
 	var privileged int
 
-	ndevName := options[networkDevice]
+	nw.genNw = genNw
+
+	pfNames, err := resolvePfNames(d.hw, options[networkDevice])
+	if err != nil {
+		return err
+	}
+	nw.pfNames = pfNames
+
+	switch options[allocStrategy] {
+	case "", allocPack, allocRoundRobin, allocLeastUsed:
+	default:
+		return fmt.Errorf("Invalid %s: %s, valid strategies are: %s, %s and %s",
+			allocStrategy, options[allocStrategy], allocPack, allocRoundRobin, allocLeastUsed)
+	}
+	nw.allocation = options[allocStrategy]
+	if nw.allocation == "" {
+		nw.allocation = allocPack
+	}
 
 	if options[sriovVlan] != "" {
 		vlan, _ = strconv.Atoi(options[sriovVlan])
 		if vlan < 0 || vlan > 4095 {
 			return fmt.Errorf("Invalid vlan id given")
 		}
-		if checkVlanNwExist(ndevName, vlan) {
+		if d.vlanInUse(pfNames, vlan) {
 			return fmt.Errorf("vlan already exist")
 		}
 	}
@@ -83,7 +181,7 @@ func (nw *sriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 		var value int
 		value, err1 = strconv.Atoi(options[roceHopLimit])
 		if err1 != nil {
-			return fmt.Errorf("Invalid roceHopLimit: ", err1)
+			return fmt.Errorf("Invalid roceHopLimit: %v", err1)
 		}
 		if value < 0 || value > 255 {
 			return fmt.Errorf("Valid range of rocehoplimit is: [0..255]")
@@ -91,65 +189,394 @@ func (nw *sriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 		nw.roceHopLimit = uint8(value)
 	}
 
-	nw.genNw = genNw
+	nw.minTxRate, err = parseTxRate(minTxRate, options[minTxRate])
+	if err != nil {
+		return err
+	}
+	nw.maxTxRate, err = parseTxRate(maxTxRate, options[maxTxRate])
+	if err != nil {
+		return err
+	}
+	err = nw.validateTxRates(log, nw.minTxRate, nw.maxTxRate)
+	if err != nil {
+		return err
+	}
+
+	switch options[vfDriver] {
+	case "":
+	case vfioPciDriver:
+		if nw.roceHopLimit != 0 {
+			return fmt.Errorf("%s is not supported with %s=%s", roceHopLimit, vfDriver, vfioPciDriver)
+		}
+	default:
+		return fmt.Errorf("Invalid %s: %s, valid drivers are: %s", vfDriver, options[vfDriver], vfioPciDriver)
+	}
+	nw.vfDriver = options[vfDriver]
 
-	err = nw.DiscoverVFs(ndevName)
+	var numVfs int
+	if options[sriovNumVfs] != "" {
+		numVfs, err = strconv.Atoi(options[sriovNumVfs])
+		if err != nil || numVfs < 0 {
+			return fmt.Errorf("Invalid %s: %s", sriovNumVfs, options[sriovNumVfs])
+		}
+	}
+
+	err = nw.DiscoverVFs(log, pfNames, numVfs)
 	if err != nil {
 		return err
 	}
 	// store vlan so that when VFs are attached to container, vlan will be set at that time
 	nw.vlan = vlan
-	if len(networks) == 0 {
-		networks = make(map[string]*sriovNetwork)
+
+	for _, pfNetdevName := range pfNames {
+		if nw.pfDevice(pfNetdevName).enabledByPlugin {
+			nw.sriovOwners = append(nw.sriovOwners, pfNetdevName)
+		}
+	}
+	log.WithFields(logrus.Fields{logFieldPf: strings.Join(pfNames, ","), "ipv4": nw.genNw.IPv4Data, "ipv6": nw.genNw.IPv6Data}).
+		Info("Created sriov network")
+	return nil
+}
+
+// parseTxRate parses a VF transmit rate option given in Mbps.
+func parseTxRate(name string, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	rate, err := strconv.Atoi(value)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("Invalid %s: %s", name, value)
+	}
+	return rate, nil
+}
+
+// validateTxRates checks a pair of VF transmit rates against each other
+// and against the link speed of every PF of the network.
+func (nw *sriovNetwork) validateTxRates(log *logrus.Entry, minRate int, maxRate int) error {
+	if maxRate > 0 && minRate > maxRate {
+		return fmt.Errorf("%s %d exceeds %s %d", minTxRate, minRate, maxTxRate, maxRate)
+	}
+	if minRate == 0 && maxRate == 0 {
+		return nil
+	}
+
+	for _, pfNetdevName := range nw.pfNames {
+		speed, err := nw.hw().GetLinkSpeed(pfNetdevName)
+		if err != nil || speed <= 0 {
+			// link is down or the driver does not report its speed
+			log.WithField(logFieldPf, pfNetdevName).Warn("Unknown link speed, skipping tx rate check")
+			continue
+		}
+		if minRate > speed || maxRate > speed {
+			return fmt.Errorf("tx rate exceeds %s link speed of %d Mbps", pfNetdevName, speed)
+		}
 	}
+	return nil
+}
 
-	networks[nid] = nw
+// enableSriov creates numVfs VFs on a PF which has SR-IOV disabled.
+func enableSriov(log *logrus.Entry, hw Hardware, pfNetdevName string, numVfs int) error {
+	totalVfs, err := hw.GetTotalVfCount(pfNetdevName)
+	if err != nil || totalVfs == 0 {
+		return fmt.Errorf("sriov unsupported for device: %s", pfNetdevName)
+	}
+	if numVfs > totalVfs {
+		return fmt.Errorf("%s supports at most %d VFs", pfNetdevName, totalVfs)
+	}
 
-	dev := pfDevices[ndevName]
-	dev.nwUseRefCount++
-	log.Printf("SRIOV CreateNetwork : [%s] IPv4Data : [ %+v ]\n", nw.genNw.id, nw.genNw.IPv4Data)
+	log.WithField(logFieldPf, pfNetdevName).Infof("Enabling %d VFs", numVfs)
+	err = hw.SetEnabledVfCount(pfNetdevName, numVfs)
+	if err != nil {
+		return fmt.Errorf("Fail to enable sriov on %s: %v", pfNetdevName, err)
+	}
 	return nil
 }
 
-func initSriovState(pfNetdevName string, dev *pfDevice) error {
+func initSriovState(log *logrus.Entry, hw Hardware, pfNetdevName string, dev *pfDevice, numVfs int) error {
 	var err error
 
-	if !sriovnet.IsSriovEnabled(pfNetdevName) {
-		return fmt.Errorf("sriov not enabled!")
+	if !hw.IsSriovEnabled(pfNetdevName) {
+		if numVfs == 0 {
+			return fmt.Errorf("sriov not enabled!")
+		}
+		err = enableSriov(log, hw, pfNetdevName, numVfs)
+		if err != nil {
+			return err
+		}
+		dev.enabledByPlugin = true
 	}
 
-	dev.pfHandle, err = sriovnet.GetPfNetdevHandle(pfNetdevName)
+	dev.pfHandle, err = hw.GetPfHandle(pfNetdevName)
 	if err != nil {
-		log.Println("fail to get handle: ", pfNetdevName, err)
+		if dev.enabledByPlugin {
+			hw.SetEnabledVfCount(pfNetdevName, 0)
+		}
 		return fmt.Errorf("Fail to get device handle: %v", err)
 	}
 
+	dev.numaNode = hw.GetNumaNode(pfNetdevName)
 	dev.state = SRIOV_ENABLED
 	return nil
 }
 
-func (nw *sriovNetwork) DiscoverVFs(pfNetdevName string) error {
+func (nw *sriovNetwork) DiscoverVFs(log *logrus.Entry, pfNetdevNames []string, numVfs int) error {
 	var err error
+	var discovered []string
 
-	if len(pfDevices) == 0 {
-		pfDevices = make(map[string]*pfDevice)
-	}
-
-	dev := pfDevices[pfNetdevName]
-	if dev == nil {
+	d := nw.genNw.driver
+	for _, pfNetdevName := range pfNetdevNames {
+		dev := d.getPfDevice(pfNetdevName)
+		if dev != nil {
+			continue
+		}
 		newDev := pfDevice{}
-		err = initSriovState(pfNetdevName, &newDev)
+		err = initSriovState(log, d.hw, pfNetdevName, &newDev, numVfs)
 		if err != nil {
+			// forget PFs discovered for this network only
+			for _, name := range discovered {
+				d.releasePfDevice(log, name)
+			}
 			return err
 		}
-		pfDevices[pfNetdevName] = &newDev
-		dev = &newDev
+		d.addPfDevice(pfNetdevName, &newDev)
+		discovered = append(discovered, pfNetdevName)
+		d.restoreQuarantinedVfs(log, &newDev)
+		if !newDev.enabledByPlugin {
+			d.applyReservedVfs(&newDev)
+		}
 	}
 	return nil
 }
 
-func (nw *sriovNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
-	var vfObj *sriovnet.VfObj
+// restoreQuarantinedVfs marks the stored quarantined VFs of a newly found
+// PF allocated again, so that they stay out of the free pool across plugin
+// restarts. VFs which the plugin just created by enabling SR-IOV start out
+// reset, so their stale records are dropped instead.
+func (d *driver) restoreQuarantinedVfs(log *logrus.Entry, dev *pfDevice) {
+	var vfList map[string]*DbVfInfo
+	err := d.store.View(func(tx StoreTx) error {
+		var err error
+		vfList, err = tx.Vfs()
+		return err
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to read stored VFs")
+		return
+	}
+
+	var stale []string
+	dev.lock.Lock()
+	for _, vf := range dev.pfHandle.List {
+		info := vfList[vf.PciAddress]
+		if info == nil || info.Quarantined == "" {
+			continue
+		}
+		if dev.enabledByPlugin {
+			stale = append(stale, vf.PciAddress)
+			continue
+		}
+		vf.Allocated = true
+		if dev.quarantinedVfs == nil {
+			dev.quarantinedVfs = make(map[int]string)
+		}
+		dev.quarantinedVfs[vf.Index] = info.Quarantined
+		vfLogger(log, dev.pfHandle.PfNetdevName, vf.Index).WithField("reason", info.Quarantined).
+			Warn("VF stays quarantined")
+	}
+	dev.lock.Unlock()
+
+	if len(stale) == 0 {
+		return
+	}
+	err = d.store.Update(func(tx StoreTx) error {
+		for _, pciAddr := range stale {
+			err := tx.DeleteVf(pciAddr)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Fail to delete records of recreated VFs")
+	}
+}
+
+// resetStuckVf resets an allocated VF without endpoint and frees it, or
+// quarantines it when it cannot be reset. It must be called with the
+// driver lock held for writing.
+func (d *driver) resetStuckVf(log *logrus.Entry, dev *pfDevice, vfObj *sriovnet.VfObj) error {
+	pfNetdevName := dev.pfHandle.PfNetdevName
+	err := d.hw.ResetVfConfig(pfNetdevName, vfObj.Index, nil)
+	delete(d.reservedVfs, vfObj.PciAddress)
+
+	storeErr := d.store.Update(func(tx StoreTx) error {
+		if err == nil {
+			return tx.DeleteVf(vfObj.PciAddress)
+		}
+		return tx.PutVf(vfObj.PciAddress, &DbVfInfo{PfNetdev: pfNetdevName, VfIndex: vfObj.Index, Quarantined: err.Error()})
+	})
+	if storeErr != nil {
+		log.WithError(storeErr).Error("Fail to store released VF")
+	}
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+	if err != nil {
+		dev.quarantineVf(log, vfObj, err)
+		return err
+	}
+	delete(dev.quarantinedVfs, vfObj.Index)
+	sriovnet.FreeVf(dev.pfHandle, vfObj)
+	return nil
+}
+
+// releaseReservedVfs releases the reserved VFs of a deleted network. It
+// must be called with the driver lock held for writing.
+func (d *driver) releaseReservedVfs(log *logrus.Entry, nid string) {
+	for pciAddr, info := range d.reservedVfs {
+		if info.NetworkID != nid {
+			continue
+		}
+		vfLog := vfLogger(log.WithField(logFieldEndpoint, info.EndpointID), info.PfNetdev, info.VfIndex)
+
+		// looked up by PCI address, as the PF may have been renamed
+		var dev *pfDevice
+		var vfObj *sriovnet.VfObj
+		for _, pfDev := range d.pfDevices {
+			pfDev.lock.Lock()
+			for _, vf := range pfDev.pfHandle.List {
+				if vf.PciAddress == pciAddr {
+					dev, vfObj = pfDev, vf
+				}
+			}
+			pfDev.lock.Unlock()
+		}
+		if vfObj == nil {
+			// the PF is not used, so the VF was never marked allocated
+			delete(d.reservedVfs, pciAddr)
+			err := d.store.Update(func(tx StoreTx) error {
+				return tx.DeleteVf(pciAddr)
+			})
+			if err != nil {
+				vfLog.WithError(err).Error("Fail to delete stored VF")
+			}
+			continue
+		}
+		err := d.resetStuckVf(vfLog, dev, vfObj)
+		if err == nil {
+			vfLog.Info("Released reserved VF of deleted network")
+		}
+	}
+}
+
+// allocateVf picks a VF from the PFs of the network according to its
+// allocation strategy, or the VF with the given MAC address if any.
+// PFs on the given NUMA node are preferred over the others.
+func (nw *sriovNetwork) allocateVf(log *logrus.Entry, macAddress string, node int) (*pfDevice, *sriovnet.VfObj, error) {
+	nw.genNw.lock.Lock()
+	defer nw.genNw.lock.Unlock()
+
+	if macAddress != "" {
+		for _, pfNetdevName := range nw.pfNames {
+			dev := nw.pfDevice(pfNetdevName)
+			vfObj, err := dev.allocateVfByMacAddress(log, nw.hw(), macAddress)
+			if err == nil {
+				return dev, vfObj, nil
+			}
+		}
+		nw.genNw.driver.metrics.vfAllocFailures.WithLabelValues(nw.genNw.id).Inc()
+		return nil, nil, fmt.Errorf("no free VF with mac address %s on %s",
+			macAddress, strings.Join(nw.pfNames, ","))
+	}
+
+	candidates := make([]string, 0, len(nw.pfNames))
+	switch nw.allocation {
+	case allocRoundRobin:
+		for i := range nw.pfNames {
+			candidates = append(candidates, nw.pfNames[(nw.nextPf+i)%len(nw.pfNames)])
+		}
+	case allocLeastUsed:
+		candidates = append(candidates, nw.pfNames...)
+		freeVfs := make(map[string]int)
+		for _, pfNetdevName := range candidates {
+			freeVfs[pfNetdevName] = nw.pfDevice(pfNetdevName).freeVfCount()
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return freeVfs[candidates[i]] > freeVfs[candidates[j]]
+		})
+	default:
+		candidates = append(candidates, nw.pfNames...)
+	}
+
+	if node >= 0 {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return nw.pfDevice(candidates[i]).numaNode == node &&
+				nw.pfDevice(candidates[j]).numaNode != node
+		})
+		if nw.pfDevice(candidates[0]).numaNode != node {
+			log.Warnf("No PF of %s on NUMA node %d", strings.Join(nw.pfNames, ","), node)
+		}
+	}
+
+	for _, pfNetdevName := range candidates {
+		dev := nw.pfDevice(pfNetdevName)
+		dev.lock.Lock()
+		vfObj, err := sriovnet.AllocateVf(dev.pfHandle)
+		dev.lock.Unlock()
+		if err != nil {
+			log.WithField(logFieldPf, pfNetdevName).WithError(err).Debug("Fail to allocate VF")
+			continue
+		}
+		if nw.allocation == allocRoundRobin {
+			for i, name := range nw.pfNames {
+				if name == pfNetdevName {
+					nw.nextPf = (i + 1) % len(nw.pfNames)
+				}
+			}
+		}
+		return dev, vfObj, nil
+	}
+	nw.genNw.driver.metrics.vfAllocFailures.WithLabelValues(nw.genNw.id).Inc()
+	return nil, nil, fmt.Errorf("all Vfs for %s are allocated", strings.Join(nw.pfNames, ","))
+}
+
+// allocateVfByMacAddress allocates the free VF of a PF with the given MAC
+// address.
+func (dev *pfDevice) allocateVfByMacAddress(log *logrus.Entry, hw Hardware, macAddress string) (*sriovnet.VfObj, error) {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	for _, vf := range dev.pfHandle.List {
+		if vf.Allocated {
+			continue
+		}
+		vfMacAddress, _ := hw.GetVfMacAddress(dev.pfHandle.PfNetdevName, vf.Index)
+		if vfMacAddress != macAddress {
+			continue
+		}
+		vf.Allocated = true
+		vfLogger(log, dev.pfHandle.PfNetdevName, vf.Index).Infof("Allocated VF by mac address %s", macAddress)
+		return vf, nil
+	}
+	return nil, fmt.Errorf("all Vfs for %v are allocated for mac address %v",
+		dev.pfHandle.PfNetdevName, macAddress)
+}
+
+func (dev *pfDevice) freeVfCount() int {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	count := 0
+	for _, vf := range dev.pfHandle.List {
+		if !vf.Allocated {
+			count++
+		}
+	}
+	return count
+}
+
+func (nw *sriovNetwork) CreateEndpoint(log *logrus.Entry, r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
 	var err error
 	var privileged bool
 
@@ -159,46 +586,100 @@ func (nw *sriovNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*netwo
 		privileged = false
 	}
 
-	dev := pfDevices[nw.genNw.ndevName]
-	if dev.pfHandle == nil {
-		return nil, fmt.Errorf("Invalid SRIOV configuration")
+	epOptions := parseEndpointOptions(r.Options)
+
+	minRate, maxRate, err := nw.endpointTxRates(log, epOptions)
+	if err != nil {
+		return nil, err
 	}
 
-	if r.Interface.MacAddress != "" {
-		vfObj, err = sriovnet.AllocateVfByMacAddress(dev.pfHandle, r.Interface.MacAddress)
-	} else {
-		vfObj, err = sriovnet.AllocateVf(dev.pfHandle)
+	node, err := nw.endpointNumaNode(log, epOptions)
+	if err != nil {
+		return nil, err
 	}
 
+	dev, vfObj, err := nw.allocateVf(log, r.Interface.MacAddress, node)
 	if err != nil {
 		return nil, fmt.Errorf("Fail to allocate VF err = %v", err)
 	}
+	pfNetdevName := dev.pfHandle.PfNetdevName
+	hw := nw.hw()
+	log = vfLogger(log, pfNetdevName, vfObj.Index)
+
+	ndev := &ptEndpoint{
+		id:        r.EndpointID,
+		devName:   hw.GetVfNetdevName(pfNetdevName, vfObj.Index),
+		pfName:    pfNetdevName,
+		vfObj:     vfObj,
+		Address:   r.Interface.Address,
+		minTxRate: minRate,
+		maxTxRate: maxRate,
+		created:   time.Now(),
+	}
+
+	// remember the MAC address the VF had before it was handed out,
+	// it is restored when the VF is released.
+	baseInfo, err := hw.GetVfInfo(pfNetdevName, vfObj.Index)
+	if err != nil {
+		log.WithError(err).Warn("Fail to read VF config")
+	} else {
+		ndev.vfBaseMac = baseInfo.Mac.String()
+	}
 
 	if nw.vlan > 0 {
-		sriovnet.SetVfVlan(dev.pfHandle, vfObj, nw.vlan)
+		hw.SetVfVlan(pfNetdevName, vfObj.Index, nw.vlan)
 	}
 
-	err2 := sriovnet.SetVfPrivileged(dev.pfHandle, vfObj, privileged)
+	err2 := hw.SetVfPrivileged(pfNetdevName, vfObj.Index, privileged)
 	if err2 != nil {
-		sriovnet.FreeVf(dev.pfHandle, vfObj)
+		nw.abortEndpoint(log, dev, ndev)
 		return nil, fmt.Errorf("Fail to set priviledged err = %v", err2)
 	}
 
+	if minRate > 0 || maxRate > 0 {
+		err = hw.SetVfRate(pfNetdevName, vfObj.Index, minRate, maxRate)
+		if err != nil {
+			nw.abortEndpoint(log, dev, ndev)
+			return nil, fmt.Errorf("Fail to set tx rate err = %v", err)
+		}
+	}
+
 	if nw.roceHopLimit != 0 {
-		err = setRoceHopLimitWA(sriovnet.GetVfNetdevName(dev.pfHandle, vfObj), nw.roceHopLimit)
+		ndev.baseHopLimit, err = hw.GetRoceHopLimit(ndev.devName)
+		if err != nil {
+			nw.abortEndpoint(log, dev, ndev)
+			return nil, fmt.Errorf("Fail to read RoCE Hoplimit = %v", err)
+		}
+		err = hw.SetRoceHopLimit(ndev.devName, nw.roceHopLimit)
 		if err != nil {
+			nw.abortEndpoint(log, dev, ndev)
 			return nil, fmt.Errorf("Fail to set RoCE Hoplimit = %v", err)
 		}
+		ndev.hopLimitSet = true
 	}
 
-	log.Printf("AllocVF PF [ %+v ] vf:%v\n", nw.genNw.ndevName, vfObj)
+	if nw.vfDriver == vfioPciDriver {
+		ndev.origVfDriver, err = hw.BindVfio(vfObj.PciAddress)
+		if err != nil {
+			nw.abortEndpoint(log, dev, ndev)
+			return nil, fmt.Errorf("Fail to bind VF to %s err = %v", vfioPciDriver, err)
+		}
+		ndev.vfioBound = true
+		// the VF has no netdevice left to move into the container
+		ndev.devName = ""
 
-	ndev := &ptEndpoint{
-		devName: sriovnet.GetVfNetdevName(dev.pfHandle, vfObj),
-		vfObj:   vfObj,
-		Address: r.Interface.Address,
+		ndev.iommuGroup, err = hw.GetIommuGroup(vfObj.PciAddress)
+		if err != nil {
+			nw.abortEndpoint(log, dev, ndev)
+			return nil, fmt.Errorf("Fail to get iommu group of VF err = %v", err)
+		}
 	}
+
+	log.WithField("pci", vfObj.PciAddress).Info("Allocated VF")
+
+	nw.genNw.lock.Lock()
 	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
+	nw.genNw.lock.Unlock()
 
 	endpointInterface := &network.EndpointInterface{}
 	if r.Interface.Address == "" {
@@ -206,25 +687,275 @@ func (nw *sriovNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*netwo
 	}
 	resp := &network.CreateEndpointResponse{Interface: endpointInterface}
 
-	log.Printf("SRIOV CreateEndpoint resp interface: [ %+v ]\n", resp.Interface)
 	return resp, nil
 }
 
-func (nw *sriovNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
-	dev := pfDevices[nw.genNw.ndevName]
+func (nw *sriovNetwork) DeleteEndpoint(log *logrus.Entry, endpoint *ptEndpoint) error {
+	dev := nw.pfDevice(endpoint.pfName)
+	return nw.releaseVf(vfLogger(log, endpoint.pfName, endpoint.vfObj.Index), dev, endpoint)
+}
+
+// abortEndpoint releases the VF of an endpoint which failed to be created.
+// The VF is not stored yet, so a quarantine is stored on its own.
+func (nw *sriovNetwork) abortEndpoint(log *logrus.Entry, dev *pfDevice, endpoint *ptEndpoint) {
+	err := nw.releaseVf(log, dev, endpoint)
+	if err != nil {
+		nw.genNw.driver.storeQuarantine(log, nw.genNw.id, endpoint, err)
+	}
+}
+
+// releaseVf resets the VF of an endpoint and returns it to the free pool.
+// A VF that cannot be reset is quarantined instead, so that it is never
+// handed to another container with the settings of this one, and the
+// reason is returned.
+func (nw *sriovNetwork) releaseVf(log *logrus.Entry, dev *pfDevice, endpoint *ptEndpoint) error {
+	err := nw.scrubVf(dev, endpoint)
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+	if err != nil {
+		dev.quarantineVf(log, endpoint.vfObj, err)
+		return err
+	}
 	sriovnet.FreeVf(dev.pfHandle, endpoint.vfObj)
+	log.Info("Released VF")
+	return nil
+}
+
+func (nw *sriovNetwork) scrubVf(dev *pfDevice, endpoint *ptEndpoint) error {
+	var mac net.HardwareAddr
+	var err error
+
+	vfObj := endpoint.vfObj
+	hw := nw.hw()
+
+	if endpoint.vfioBound {
+		err = hw.BindDriver(vfObj.PciAddress, endpoint.origVfDriver)
+		if err != nil {
+			return fmt.Errorf("fail to rebind to %s: %v", endpoint.origVfDriver, err)
+		}
+	}
+
+	if endpoint.hopLimitSet {
+		err = hw.SetRoceHopLimit(hw.GetVfNetdevName(endpoint.pfName, vfObj.Index), endpoint.baseHopLimit)
+		if err != nil {
+			return fmt.Errorf("fail to reset RoCE hop limit: %v", err)
+		}
+	}
+
+	if endpoint.vfBaseMac != "" {
+		mac, err = net.ParseMAC(endpoint.vfBaseMac)
+		if err != nil {
+			return err
+		}
+	}
+	return hw.ResetVfConfig(endpoint.pfName, vfObj.Index, mac)
 }
 
-func (nw *sriovNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkRequest) {
-	dev := pfDevices[nw.genNw.ndevName]
-	dev.nwUseRefCount--
+func (dev *pfDevice) quarantineVf(log *logrus.Entry, vfObj *sriovnet.VfObj, reason error) {
+	if dev.quarantinedVfs == nil {
+		dev.quarantinedVfs = make(map[int]string)
+	}
+	dev.quarantinedVfs[vfObj.Index] = reason.Error()
+	log.WithError(reason).Error("Quarantined VF, fail to reset it")
+}
 
-	// multiple vlan based network will share enabled VFs.
-	// So first created network enables SRIOV and
-	// Last network that gets deleted, disables SRIOV.
-	if dev.nwUseRefCount == 0 {
-		delete(pfDevices, nw.genNw.ndevName)
+// findVf looks up the VF of a persisted endpoint by its PCI address,
+// falling back to the VF index for records without one.
+func findVf(pfHandle *sriovnet.PfNetdevHandle, info *DbEndpointInfo) *sriovnet.VfObj {
+	for _, vf := range pfHandle.List {
+		if info.VfPciAddress != "" && vf.PciAddress == info.VfPciAddress {
+			return vf
+		}
+	}
+	if info.VfPciAddress != "" {
+		return nil
+	}
+	for _, vf := range pfHandle.List {
+		if vf.Index == info.VfIndex {
+			return vf
+		}
 	}
-	delete(networks, nw.genNw.id)
-	log.Printf("DeleteNetwork: total networks = %d\n", len(networks))
+	return nil
+}
+
+// endpointPf returns the PF of a persisted endpoint. It is found by the PCI
+// address of the VF first, as the PF may have been renamed since the
+// endpoint was stored.
+func (nw *sriovNetwork) endpointPf(info *DbEndpointInfo) (string, error) {
+	if info.VfPciAddress != "" {
+		for _, pfNetdevName := range nw.pfNames {
+			dev := nw.pfDevice(pfNetdevName)
+			if dev.pfHandle == nil {
+				continue
+			}
+			dev.lock.Lock()
+			vfObj := findVf(dev.pfHandle, info)
+			dev.lock.Unlock()
+			if vfObj != nil {
+				return pfNetdevName, nil
+			}
+		}
+	}
+
+	pfNetdevName := info.PfNetdev
+	if pfNetdevName == "" {
+		pfNetdevName = nw.pfNames[0]
+	}
+	if !nw.usesPf(pfNetdevName) {
+		return "", fmt.Errorf("PF %s is not part of network %s", pfNetdevName, nw.genNw.id)
+	}
+	return pfNetdevName, nil
+}
+
+func (nw *sriovNetwork) RestoreEndpoint(log *logrus.Entry, id string, info *DbEndpointInfo) error {
+	pfNetdevName, err := nw.endpointPf(info)
+	if err != nil {
+		return err
+	}
+	if pfNetdevName != info.PfNetdev && info.PfNetdev != "" {
+		log.WithField(logFieldPf, pfNetdevName).Warnf("PF %s of endpoint was renamed", info.PfNetdev)
+	}
+	dev := nw.pfDevice(pfNetdevName)
+	if dev.pfHandle == nil {
+		return fmt.Errorf("Invalid SRIOV configuration")
+	}
+
+	dev.lock.Lock()
+	vfObj := findVf(dev.pfHandle, info)
+	if vfObj == nil {
+		dev.lock.Unlock()
+		return fmt.Errorf("VF %d [%s] not found on %s", info.VfIndex, info.VfPciAddress, pfNetdevName)
+	}
+	if vfObj.Allocated {
+		dev.lock.Unlock()
+		return fmt.Errorf("VF %d [%s] is already allocated", vfObj.Index, vfObj.PciAddress)
+	}
+	vfObj.Allocated = true
+	dev.lock.Unlock()
+
+	vfLogger(log, pfNetdevName, vfObj.Index).WithField("pci", vfObj.PciAddress).Info("Restored VF")
+
+	ndev := &ptEndpoint{
+		id:         id,
+		devName:    info.DevName,
+		pfName:     pfNetdevName,
+		vfObj:      vfObj,
+		Address:    info.Address,
+		sandboxKey: info.SandboxKey,
+		minTxRate:  info.MinTxRate,
+		maxTxRate:  info.MaxTxRate,
+
+		vfBaseMac:    info.VfBaseMac,
+		baseHopLimit: info.BaseHopLimit,
+		hopLimitSet:  info.HopLimitSet,
+		origVfDriver: info.OrigVfDriver,
+		vfioBound:    info.VfioBound,
+		iommuGroup:   info.IommuGroup,
+	}
+	nw.genNw.lock.Lock()
+	nw.genNw.ndevEndpoints[id] = ndev
+	nw.genNw.lock.Unlock()
+	return nil
+}
+
+// endpointTxRates returns the transmit rates for a new endpoint, where
+// rates given as endpoint driver options override those of the network.
+func (nw *sriovNetwork) endpointTxRates(log *logrus.Entry, epOptions map[string]string) (int, int, error) {
+	minRate := nw.minTxRate
+	maxRate := nw.maxTxRate
+
+	if epOptions[minTxRate] == "" && epOptions[maxTxRate] == "" {
+		return minRate, maxRate, nil
+	}
+
+	if epOptions[minTxRate] != "" {
+		rate, err := parseTxRate(minTxRate, epOptions[minTxRate])
+		if err != nil {
+			return 0, 0, err
+		}
+		minRate = rate
+	}
+	if epOptions[maxTxRate] != "" {
+		rate, err := parseTxRate(maxTxRate, epOptions[maxTxRate])
+		if err != nil {
+			return 0, 0, err
+		}
+		maxRate = rate
+	}
+
+	err := nw.validateTxRates(log, minRate, maxRate)
+	if err != nil {
+		return 0, 0, err
+	}
+	return minRate, maxRate, nil
+}
+
+// restoreSriovOwners marks SR-IOV enabled by an earlier instance of the
+// plugin as still owned by the plugin, even though it was already on at
+// startup.
+func (nw *sriovNetwork) restoreSriovOwners(pfNetdevNames []string) {
+	for _, pfNetdevName := range pfNetdevNames {
+		dev := nw.pfDevice(pfNetdevName)
+		if dev == nil || !nw.usesPf(pfNetdevName) {
+			continue
+		}
+		dev.enabledByPlugin = true
+		nw.sriovOwners = append(nw.sriovOwners, pfNetdevName)
+	}
+}
+
+// endpointNumaNode returns the NUMA node whose PFs are preferred for a
+// new endpoint, or -1 for no preference. The node is given as endpoint
+// driver option or derived from the cpuset of the container.
+func (nw *sriovNetwork) endpointNumaNode(log *logrus.Entry, epOptions map[string]string) (int, error) {
+	if epOptions[numaNode] != "" {
+		node, err := strconv.Atoi(epOptions[numaNode])
+		if err != nil || node < 0 {
+			return -1, fmt.Errorf("Invalid %s: %s", numaNode, epOptions[numaNode])
+		}
+		return node, nil
+	}
+
+	// the container is only looked up when there is a choice to make
+	if !nw.spansNumaNodes() {
+		return -1, nil
+	}
+
+	cpuset, err := GetPendingContainerCpuset(nw.genNw.id)
+	if err != nil {
+		log.WithError(err).Warn("Fail to get container cpuset")
+		return -1, nil
+	}
+	if cpuset == "" {
+		return -1, nil
+	}
+
+	node, err := nw.hw().GetCpuListNumaNode(cpuset)
+	if err != nil {
+		log.WithError(err).Warnf("Fail to get NUMA node of cpuset %s", cpuset)
+		return -1, nil
+	}
+	return node, nil
+}
+
+func (nw *sriovNetwork) spansNumaNodes() bool {
+	node := -1
+	for _, pfNetdevName := range nw.pfNames {
+		pfNode := nw.pfDevice(pfNetdevName).numaNode
+		if pfNode < 0 {
+			continue
+		}
+		if node >= 0 && pfNode != node {
+			return true
+		}
+		node = pfNode
+	}
+	return false
+}
+
+// DeleteNetwork has nothing to tear down, the PFs of the network are
+// released by the driver when it removes the network.
+func (nw *sriovNetwork) DeleteNetwork(log *logrus.Entry, d *driver, req *network.DeleteNetworkRequest) {
+	log.Info("Deleted sriov network")
 }
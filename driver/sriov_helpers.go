@@ -1,13 +1,20 @@
 package driver
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
+	"github.com/k8snetworkplumbingwg/sriovnet"
 	"github.com/vishvananda/netlink"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/internal/cpulist"
 )
 
 const (
@@ -18,7 +25,22 @@ const (
 	netdevBindFile   = "bind"
 
 	netDevCurrentVFCountFile = "sriov_numvfs"
+	netDevTotalVFCountFile   = "sriov_totalvfs"
 	netDevVFDevicePrefix     = "virtfn"
+	netDevSpeedFile          = "speed"
+	netDevNumaNodeFile       = "numa_node"
+
+	nodeSysDir      = "/sys/devices/system/node"
+	nodeCpuListFile = "cpulist"
+
+	pciDevicesDir         = "/sys/bus/pci/devices"
+	pciDriversDir         = "/sys/bus/pci/drivers"
+	pciDriversProbeFile   = "/sys/bus/pci/drivers_probe"
+	pciDriverLink         = "driver"
+	pciDriverOverrideFile = "driver_override"
+	pciIommuGroupLink     = "iommu_group"
+
+	vfioPciDriver = "vfio-pci"
 )
 
 func netDevDeviceDir(netDevName string) string {
@@ -46,11 +68,25 @@ func netdevGetEnabledVFCount(name string) (int, error) {
 	if err != nil {
 		return 0, err
 	} else {
-		fmt.Println("cur_vfs = ", curVfs)
+		logger.WithField(logFieldPf, name).Debugf("cur_vfs = %d", curVfs)
 		return curVfs, nil
 	}
 }
 
+func netdevGetTotalVFCount(name string) (int, error) {
+	file := netDevDeviceDir(name) + "/" + netDevTotalVFCountFile
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func netdevSetEnabledVFCount(name string, vfCount int) error {
+	file := netDevDeviceDir(name) + "/" + netDevCurrentVFCountFile
+	return ioutil.WriteFile(file, []byte(strconv.Itoa(vfCount)), 0644)
+}
+
 func SetVFVlan(parentNetdev string, vfDir string, vlan int) error {
 	vfIndexStr := strings.TrimPrefix(vfDir, "virtfn")
 	vfIndex, _ := strconv.Atoi(vfIndexStr)
@@ -84,13 +120,307 @@ func SetVFPrivileged(parentNetdev string, vfDir string, privileged bool) error {
 		return err
 	}
 	/* do not check for error status as older kernels doesn't
-	 * have support for it.
+	 * have support for it, the read back below checks the result.
 	 */
 	netlink.LinkSetVfTrust(parentHandle, vfIndex, trusted)
 	netlink.LinkSetVfSpoofchk(parentHandle, vfIndex, spoofChk)
 	return err
 }
 
+// SetVFRate sets the min/max transmit rate of a VF in Mbps.
+// A rate of 0 removes the corresponding limit.
+func SetVFRate(parentNetdev string, vfIndex int, minRate int, maxRate int) error {
+	parentHandle, err := netlink.LinkByName(parentNetdev)
+	if err != nil {
+		return err
+	}
+
+	return netlink.LinkSetVfRate(parentHandle, vfIndex, minRate, maxRate)
+}
+
+// netdevGetVFInfo returns the VF configuration as reported by its PF.
+func netdevGetVFInfo(parentNetdev string, vfIndex int) (*netlink.VfInfo, error) {
+	parentHandle, err := netlink.LinkByName(parentNetdev)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vf := range parentHandle.Attrs().Vfs {
+		if vf.ID == vfIndex {
+			return &vf, nil
+		}
+	}
+	return nil, fmt.Errorf("vf %d not found on %s", vfIndex, parentNetdev)
+}
+
+func netdevGetVFInfos(parentNetdev string) ([]netlink.VfInfo, error) {
+	parentHandle, err := netlink.LinkByName(parentNetdev)
+	if err != nil {
+		return nil, err
+	}
+	return parentHandle.Attrs().Vfs, nil
+}
+
+// ResetVFConfig restores a VF to the unprivileged baseline: no vlan,
+// no tx rate limits, not trusted, spoof check on and the given MAC
+// address, if any. The resulting configuration is read back from the PF
+// so that a VF which could not be reset is reported as an error.
+func ResetVFConfig(parentNetdev string, vfIndex int, mac net.HardwareAddr) error {
+	parentHandle, err := netlink.LinkByName(parentNetdev)
+	if err != nil {
+		return err
+	}
+
+	/* drivers without vlan or tx rate support on VFs refuse to reset
+	 * them, the read back below still checks they are not set.
+	 */
+	err = netlink.LinkSetVfVlanQos(parentHandle, vfIndex, 0, 0)
+	if err != nil && !errors.Is(err, syscall.EOPNOTSUPP) {
+		return fmt.Errorf("fail to reset vlan: %v", err)
+	}
+	err = netlink.LinkSetVfRate(parentHandle, vfIndex, 0, 0)
+	if err != nil && !errors.Is(err, syscall.EOPNOTSUPP) {
+		return fmt.Errorf("fail to reset tx rate: %v", err)
+	}
+	if mac != nil {
+		err = netlink.LinkSetVfHardwareAddr(parentHandle, vfIndex, mac)
+		if err != nil {
+			return fmt.Errorf("fail to reset mac address: %v", err)
+		}
+	}
+	/* do not check for error status as older kernels doesn't
+	 * have support for it, the read back below checks the result.
+	 */
+	netlink.LinkSetVfTrust(parentHandle, vfIndex, false)
+	netlink.LinkSetVfSpoofchk(parentHandle, vfIndex, true)
+
+	info, err := netdevGetVFInfo(parentNetdev, vfIndex)
+	if err != nil {
+		return err
+	}
+	if info.Vlan != 0 || info.Qos != 0 {
+		return fmt.Errorf("vlan %d qos %d still set", info.Vlan, info.Qos)
+	}
+	if info.Trust != 0 {
+		return fmt.Errorf("vf is still trusted")
+	}
+	if !info.Spoofchk {
+		return fmt.Errorf("spoof check is still off")
+	}
+	if info.MinTxRate != 0 || info.MaxTxRate != 0 {
+		return fmt.Errorf("tx rate %d-%d still set", info.MinTxRate, info.MaxTxRate)
+	}
+	if mac != nil && info.Mac.String() != mac.String() {
+		return fmt.Errorf("mac address is %s instead of %s", info.Mac, mac)
+	}
+	return nil
+}
+
+// netdevGetLinkSpeed returns the link speed of a netdevice in Mbps.
+func netdevGetLinkSpeed(name string) (int, error) {
+	file := netSysDir + "/" + name + "/" + netDevSpeedFile
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// pciGetDriver returns the name of the driver a PCI device is bound to,
+// or an empty string when it is not bound.
+func pciGetDriver(pciAddr string) (string, error) {
+	driverPath, err := os.Readlink(filepath.Join(pciDevicesDir, pciAddr, pciDriverLink))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return filepath.Base(driverPath), nil
+}
+
+func pciGetIommuGroup(pciAddr string) (string, error) {
+	groupPath, err := os.Readlink(filepath.Join(pciDevicesDir, pciAddr, pciIommuGroupLink))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(groupPath), nil
+}
+
+func pciUnbindDriver(pciAddr string) error {
+	unbindFile := filepath.Join(pciDevicesDir, pciAddr, pciDriverLink, netdevUnbindFile)
+	err := ioutil.WriteFile(unbindFile, []byte(pciAddr), 0200)
+	if os.IsNotExist(err) {
+		// not bound to any driver
+		return nil
+	}
+	return err
+}
+
+func pciSetDriverOverride(pciAddr string, driver string) error {
+	overrideFile := filepath.Join(pciDevicesDir, pciAddr, pciDriverOverrideFile)
+	return ioutil.WriteFile(overrideFile, []byte(driver+"\n"), 0200)
+}
+
+// pciBindVfio rebinds a PCI device to vfio-pci and returns the name of
+// the driver it was bound to before.
+func pciBindVfio(pciAddr string) (string, error) {
+	origDriver, err := pciGetDriver(pciAddr)
+	if err != nil {
+		return "", err
+	}
+	if origDriver == vfioPciDriver {
+		return origDriver, nil
+	}
+
+	err = pciUnbindDriver(pciAddr)
+	if err != nil {
+		return "", err
+	}
+	err = pciSetDriverOverride(pciAddr, vfioPciDriver)
+	if err == nil {
+		err = ioutil.WriteFile(pciDriversProbeFile, []byte(pciAddr), 0200)
+	}
+	if err == nil {
+		var driver string
+		driver, err = pciGetDriver(pciAddr)
+		if err == nil && driver != vfioPciDriver {
+			err = fmt.Errorf("%s is bound to %q, is the vfio-pci module loaded?", pciAddr, driver)
+		}
+	}
+	if err != nil {
+		pciBindDriver(pciAddr, origDriver)
+		return "", err
+	}
+	return origDriver, nil
+}
+
+// pciBindDriver rebinds a PCI device to the given driver, or lets the
+// kernel pick one when driver is empty.
+func pciBindDriver(pciAddr string, driver string) error {
+	err := pciUnbindDriver(pciAddr)
+	if err != nil {
+		return err
+	}
+	err = pciSetDriverOverride(pciAddr, "")
+	if err != nil {
+		return err
+	}
+	if driver == "" {
+		return ioutil.WriteFile(pciDriversProbeFile, []byte(pciAddr), 0200)
+	}
+	bindFile := filepath.Join(pciDriversDir, driver, netdevBindFile)
+	return ioutil.WriteFile(bindFile, []byte(pciAddr), 0200)
+}
+
+// netdevGetNumaNode returns the NUMA node of the PCI device of a
+// netdevice, or -1 when it is unknown.
+func netdevGetNumaNode(name string) int {
+	b, err := ioutil.ReadFile(netDevDeviceDir(name) + "/" + netDevNumaNodeFile)
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// cpuListNumaNode returns the NUMA node holding most of the given cpus,
+// or -1 when none of them belongs to a known node.
+func cpuListNumaNode(cpuList string) (int, error) {
+	cpus, err := cpulist.Parse(cpuList)
+	if err != nil {
+		return -1, err
+	}
+
+	nodeDirs, err := filepath.Glob(filepath.Join(nodeSysDir, "node[0-9]*"))
+	if err != nil {
+		return -1, err
+	}
+
+	bestNode := -1
+	bestCount := 0
+	for _, nodeDir := range nodeDirs {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(nodeDir), "node"))
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(nodeDir, nodeCpuListFile))
+		if err != nil {
+			continue
+		}
+		nodeCpus, err := cpulist.Parse(string(b))
+		if err != nil {
+			continue
+		}
+		onNode := make(map[int]bool)
+		for _, cpu := range nodeCpus {
+			onNode[cpu] = true
+		}
+		count := 0
+		for _, cpu := range cpus {
+			if onNode[cpu] {
+				count++
+			}
+		}
+		if count > bestCount {
+			bestNode = node
+			bestCount = count
+		}
+	}
+	return bestNode, nil
+}
+
+// netdevFromPciAddress returns the netdevice of a PCI device.
+func netdevFromPciAddress(pciAddr string) (string, error) {
+	names, err := sriovnet.GetNetDevicesFromPci(pciAddr)
+	if err != nil {
+		return "", fmt.Errorf("no netdevice found for PCI device %s: %v", pciAddr, err)
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("PCI device %s has %d netdevices", pciAddr, len(names))
+	}
+	return names[0], nil
+}
+
+// netdevFromMacAddress returns the PCI netdevice with the given MAC address.
+func netdevFromMacAddress(macAddr string) (string, error) {
+	mac, err := net.ParseMAC(macAddr)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := ioutil.ReadDir(netSysDir)
+	if err != nil {
+		return "", err
+	}
+
+	var found []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// skip virtual devices such as bonds, which share the MAC address
+		if _, err = os.Stat(netDevDeviceDir(name)); err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(netSysDir, name, "address"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(b)) == mac.String() {
+			found = append(found, name)
+		}
+	}
+
+	if len(found) == 0 {
+		return "", fmt.Errorf("no netdevice found with mac address %s", macAddr)
+	}
+	if len(found) > 1 {
+		return "", fmt.Errorf("mac address %s matches netdevices %s", macAddr, strings.Join(found, ","))
+	}
+	return found[0], nil
+}
+
 func IsSRIOVSupported(netdevName string) bool {
 	maxvfs, err := netdevGetEnabledVFCount(netdevName)
 	if maxvfs == 0 || err != nil {
@@ -0,0 +1,188 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultPersistConfigPath = "/etc/docker/mellanox/docker-sriov-plugin"
+
+	stateBackendFile = "file"
+	stateBackendBolt = "bolt"
+)
+
+/* Network record, see schema.go for changing it */
+type DbNetworkInfo struct {
+	Version     uint32 `json:"Version"`
+	Netdev      string `json:"Netdev"`
+	Mode        string `json:"Mode"`
+	Gateway     string `json:"Gateway"`
+	GatewayIPv6 string `json:"GatewayIPv6,omitempty"`
+	Vlan        int    `json:"Vlan"`
+	Privileged  bool   `json:"Privileged"`
+	Prefix      string `json:"Prefix"`
+	MinTxRate   int    `json:"MinTxRate,omitempty"`
+	MaxTxRate   int    `json:"MaxTxRate,omitempty"`
+	NumVfs      int    `json:"NumVfs,omitempty"`
+	VfDriver    string `json:"VfDriver,omitempty"`
+
+	AllocStrategy string   `json:"AllocStrategy,omitempty"`
+	SriovOwners   []string `json:"SriovOwners,omitempty"`
+
+	// stable PF identifiers, resolved to the current netdevice at startup
+	PciAddress     string   `json:"PciAddress,omitempty"`
+	PfMac          string   `json:"PfMac,omitempty"`
+	PfPciAddresses []string `json:"PfPciAddresses,omitempty"`
+}
+
+/* Endpoint record, with the VF allocated to it */
+type DbEndpointInfo struct {
+	Version      uint32 `json:"Version"`
+	DevName      string `json:"DevName"`
+	PfNetdev     string `json:"PfNetdev,omitempty"`
+	VfIndex      int    `json:"VfIndex"`
+	VfPciAddress string `json:"VfPciAddress,omitempty"`
+	Address      string `json:"Address"`
+	SandboxKey   string `json:"SandboxKey,omitempty"`
+	MinTxRate    int    `json:"MinTxRate,omitempty"`
+	MaxTxRate    int    `json:"MaxTxRate,omitempty"`
+	VfBaseMac    string `json:"VfBaseMac,omitempty"`
+	BaseHopLimit uint8  `json:"BaseHopLimit,omitempty"`
+	HopLimitSet  bool   `json:"HopLimitSet,omitempty"`
+	OrigVfDriver string `json:"OrigVfDriver,omitempty"`
+	VfioBound    bool   `json:"VfioBound,omitempty"`
+	IommuGroup   string `json:"IommuGroup,omitempty"`
+}
+
+/* VF record, kept while a VF is allocated to an endpoint or quarantined */
+type DbVfInfo struct {
+	Version    uint32 `json:"Version"`
+	PfNetdev   string `json:"PfNetdev"`
+	VfIndex    int    `json:"VfIndex"`
+	NetworkID  string `json:"NetworkID,omitempty"`
+	EndpointID string `json:"EndpointID,omitempty"`
+	// reason the VF could not be reset on release
+	Quarantined string `json:"Quarantined,omitempty"`
+}
+
+// Store persists networks, their endpoints and the VFs held by them across
+// plugin restarts.
+type Store interface {
+	// View runs fn with a transaction for reading.
+	View(fn func(tx StoreTx) error) error
+	// Update runs fn with a transaction whose writes are applied together
+	// once fn returns nil, and dropped when it returns an error.
+	Update(fn func(tx StoreTx) error) error
+	Close() error
+}
+
+// StoreTx reads and writes the records of a store. Reads are not
+// guaranteed to see the writes of the same transaction.
+type StoreTx interface {
+	Networks() (map[string]*DbNetworkInfo, error)
+	PutNetwork(nid string, nw *DbNetworkInfo) error
+	// DeleteNetwork deletes a network with its endpoints.
+	DeleteNetwork(nid string) error
+
+	Endpoints(nid string) (map[string]*DbEndpointInfo, error)
+	// PutEndpoint fails when the network is not stored.
+	PutEndpoint(nid string, eid string, ep *DbEndpointInfo) error
+	DeleteEndpoint(nid string, eid string) error
+
+	// Vfs returns the VF records by VF PCI address.
+	Vfs() (map[string]*DbVfInfo, error)
+	PutVf(pciAddr string, vf *DbVfInfo) error
+	DeleteVf(pciAddr string) error
+}
+
+// OpenStore opens the store of a state backend in a state directory.
+func OpenStore(backend string, dir string) (Store, error) {
+	switch backend {
+	case stateBackendFile:
+		return newFileStore(dir), nil
+	case stateBackendBolt:
+		return openBoltStore(dir)
+	default:
+		return nil, fmt.Errorf("valid state backends are: %s and %s", stateBackendFile, stateBackendBolt)
+	}
+}
+
+// OpenStoreReadOnly opens the store of a state backend for reading it
+// while the plugin is not running. Nothing is created, imported or
+// quarantined, and updates fail. Before the plugin first imports a file
+// layout into a bolt database, the file layout is read instead.
+func OpenStoreReadOnly(backend string, dir string) (Store, error) {
+	switch backend {
+	case stateBackendFile:
+		return &fileStore{dir: dir, readOnly: true}, nil
+	case stateBackendBolt:
+		_, err := os.Stat(filepath.Join(dir, boltStoreFile))
+		if os.IsNotExist(err) {
+			return &fileStore{dir: dir, readOnly: true}, nil
+		}
+		return openBoltStoreReadOnly(dir)
+	default:
+		return nil, fmt.Errorf("valid state backends are: %s and %s", stateBackendFile, stateBackendBolt)
+	}
+}
+
+// ImportStore copies all networks, endpoints and VFs of src into dst, in a
+// single transaction of dst. It returns the IDs of the networks copied.
+func ImportStore(dst Store, src Store) ([]string, error) {
+	var nwList map[string]*DbNetworkInfo
+	var vfList map[string]*DbVfInfo
+	epLists := make(map[string]map[string]*DbEndpointInfo)
+
+	err := src.View(func(tx StoreTx) error {
+		var err error
+		nwList, err = tx.Networks()
+		if err != nil {
+			return err
+		}
+		for nid := range nwList {
+			epLists[nid], err = tx.Endpoints(nid)
+			if err != nil {
+				return err
+			}
+		}
+		vfList, err = tx.Vfs()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = dst.Update(func(tx StoreTx) error {
+		for nid, nw := range nwList {
+			err := tx.PutNetwork(nid, nw)
+			if err != nil {
+				return err
+			}
+			for eid, ep := range epLists[nid] {
+				err = tx.PutEndpoint(nid, eid, ep)
+				if err != nil {
+					return err
+				}
+			}
+			logger.WithField(logFieldNetwork, nid).Infof("Imported network with %d endpoints", len(epLists[nid]))
+		}
+		for pciAddr, vf := range vfList {
+			err := tx.PutVf(pciAddr, vf)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var nids []string
+	for nid := range nwList {
+		nids = append(nids, nid)
+	}
+	return nids, nil
+}
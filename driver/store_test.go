@@ -0,0 +1,377 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func testStores(t *testing.T, test func(t *testing.T, s Store)) {
+	for _, backend := range []string{stateBackendFile, stateBackendBolt} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			s, err := OpenStore(backend, t.TempDir())
+			if err != nil {
+				t.Fatalf("OpenStore: %v", err)
+			}
+			defer s.Close()
+			test(t, s)
+		})
+	}
+}
+
+func TestStorePutEndpointWithoutNetwork(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		err := s.Update(func(tx StoreTx) error {
+			return tx.PutEndpoint(testNetworkID, testEndpointID, &DbEndpointInfo{})
+		})
+		if err == nil {
+			t.Fatalf("endpoint stored without its network")
+		}
+
+		var nwList map[string]*DbNetworkInfo
+		err = s.View(func(tx StoreTx) error {
+			var err error
+			nwList, err = tx.Networks()
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Networks: %v", err)
+		}
+		if len(nwList) != 0 {
+			t.Errorf("network %v created by PutEndpoint", nwList)
+		}
+	})
+}
+
+func TestStoreVfs(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		err := s.Update(func(tx StoreTx) error {
+			err := tx.PutNetwork(testNetworkID, &DbNetworkInfo{})
+			if err != nil {
+				return err
+			}
+			err = tx.PutEndpoint(testNetworkID, testEndpointID, &DbEndpointInfo{VfPciAddress: "0000:03:00.2"})
+			if err != nil {
+				return err
+			}
+			err = tx.PutVf("0000:03:00.2", &DbVfInfo{PfNetdev: "ens1f0", VfIndex: 0,
+				NetworkID: testNetworkID, EndpointID: testEndpointID})
+			if err != nil {
+				return err
+			}
+			return tx.PutVf("0000:03:00.3", &DbVfInfo{PfNetdev: "ens1f0", VfIndex: 1, Quarantined: "reset failed"})
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+
+		err = s.Update(func(tx StoreTx) error {
+			return tx.DeleteVf("0000:03:00.2")
+		})
+		if err != nil {
+			t.Fatalf("DeleteVf: %v", err)
+		}
+
+		var vfList map[string]*DbVfInfo
+		err = s.View(func(tx StoreTx) error {
+			var err error
+			vfList, err = tx.Vfs()
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Vfs: %v", err)
+		}
+		if len(vfList) != 1 || vfList["0000:03:00.3"] == nil {
+			t.Fatalf("stored VFs are %v, expected 0000:03:00.3", vfList)
+		}
+		vf := vfList["0000:03:00.3"]
+		if vf.VfIndex != 1 || vf.Quarantined != "reset failed" || vf.Version != vfSchemaVersion {
+			t.Errorf("stored VF is %+v", vf)
+		}
+	})
+}
+
+func TestOpenStoreReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	s := newFileStore(dir)
+	err := s.Update(func(tx StoreTx) error {
+		return tx.PutNetwork(testNetworkID, &DbNetworkInfo{Mode: networkModeSRIOV})
+	})
+	if err != nil {
+		t.Fatalf("PutNetwork: %v", err)
+	}
+	damaged := filepath.Join(dir, "damaged")
+	err = os.MkdirAll(damaged, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(damaged, "config.json"), []byte("{"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("writing damaged network: %v", err)
+	}
+
+	for _, backend := range []string{stateBackendFile, stateBackendBolt} {
+		ro, err := OpenStoreReadOnly(backend, dir)
+		if err != nil {
+			t.Fatalf("OpenStoreReadOnly %s: %v", backend, err)
+		}
+		var nwList map[string]*DbNetworkInfo
+		err = ro.View(func(tx StoreTx) error {
+			var err error
+			nwList, err = tx.Networks()
+			return err
+		})
+		if err != nil || len(nwList) != 1 || nwList[testNetworkID] == nil {
+			t.Errorf("%s: read networks %v, %v", backend, nwList, err)
+		}
+		err = ro.Update(func(tx StoreTx) error {
+			return tx.DeleteNetwork(testNetworkID)
+		})
+		if err == nil {
+			t.Errorf("%s: update of a read only store succeeded", backend)
+		}
+		ro.Close()
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 || names[0] != testNetworkID || names[1] != "damaged" {
+		t.Errorf("state directory changed by read only stores: %v", names)
+	}
+}
+
+func TestOpenBoltStoreReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(stateBackendBolt, dir)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	err = s.Update(func(tx StoreTx) error {
+		return tx.PutNetwork(testNetworkID, &DbNetworkInfo{Mode: networkModeSRIOV})
+	})
+	s.Close()
+	if err != nil {
+		t.Fatalf("PutNetwork: %v", err)
+	}
+
+	ro, err := OpenStoreReadOnly(stateBackendBolt, dir)
+	if err != nil {
+		t.Fatalf("OpenStoreReadOnly: %v", err)
+	}
+	defer ro.Close()
+	var nwList map[string]*DbNetworkInfo
+	var vfList map[string]*DbVfInfo
+	err = ro.View(func(tx StoreTx) error {
+		var err error
+		nwList, err = tx.Networks()
+		if err == nil {
+			vfList, err = tx.Vfs()
+		}
+		return err
+	})
+	if err != nil || len(nwList) != 1 || len(vfList) != 0 {
+		t.Errorf("read networks %v and VFs %v, %v", nwList, vfList, err)
+	}
+	err = ro.Update(func(tx StoreTx) error {
+		return tx.DeleteNetwork(testNetworkID)
+	})
+	if err == nil {
+		t.Errorf("update of a read only store succeeded")
+	}
+}
+
+func storeVfList(t *testing.T, s Store) map[string]*DbVfInfo {
+	var vfList map[string]*DbVfInfo
+	err := s.View(func(tx StoreTx) error {
+		var err error
+		vfList, err = tx.Vfs()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Vfs: %v", err)
+	}
+	return vfList
+}
+
+func TestImportFileStore(t *testing.T) {
+	dir := t.TempDir()
+	err := newFileStore(dir).Update(func(tx StoreTx) error {
+		err := tx.PutNetwork(testNetworkID, &DbNetworkInfo{Mode: networkModeSRIOV})
+		if err != nil {
+			return err
+		}
+		err = tx.PutEndpoint(testNetworkID, testEndpointID, &DbEndpointInfo{VfPciAddress: "0000:03:00.2"})
+		if err != nil {
+			return err
+		}
+		return tx.PutVf("0000:03:00.2", &DbVfInfo{PfNetdev: "ens1f0", NetworkID: testNetworkID, EndpointID: testEndpointID})
+	})
+	if err != nil {
+		t.Fatalf("writing file layout: %v", err)
+	}
+
+	s, err := OpenStore(stateBackendBolt, dir)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	var epList map[string]*DbEndpointInfo
+	err = s.View(func(tx StoreTx) error {
+		var err error
+		epList, err = tx.Endpoints(testNetworkID)
+		return err
+	})
+	if err != nil || len(epList) != 1 || len(storeVfList(t, s)) != 1 {
+		t.Fatalf("imported endpoints %v and VFs %v, %v", epList, storeVfList(t, s), err)
+	}
+	for _, name := range []string{testNetworkID, vfsDir} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s not moved aside after import", name)
+		}
+	}
+	err = s.Update(func(tx StoreTx) error {
+		return tx.DeleteVf("0000:03:00.2")
+	})
+	s.Close()
+	if err != nil {
+		t.Fatalf("DeleteVf: %v", err)
+	}
+
+	// a file layout appearing later is not imported
+	err = newFileStore(dir).Update(func(tx StoreTx) error {
+		return tx.PutVf("0000:03:00.3", &DbVfInfo{PfNetdev: "ens1f0", VfIndex: 1})
+	})
+	if err != nil {
+		t.Fatalf("PutVf: %v", err)
+	}
+	s, err = OpenStore(stateBackendBolt, dir)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer s.Close()
+	if vfList := storeVfList(t, s); len(vfList) != 0 {
+		t.Errorf("VFs %v imported again on reopen", vfList)
+	}
+}
+
+func TestImportFileStoreImportedBefore(t *testing.T) {
+	dir := t.TempDir()
+	err := newFileStore(dir).Update(func(tx StoreTx) error {
+		return tx.PutVf("0000:03:00.2", &DbVfInfo{PfNetdev: "ens1f0"})
+	})
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(dir, importedDir, testNetworkID), 0755)
+	}
+	if err != nil {
+		t.Fatalf("writing file layout: %v", err)
+	}
+
+	s, err := OpenStore(stateBackendBolt, dir)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	defer s.Close()
+	if vfList := storeVfList(t, s); len(vfList) != 0 {
+		t.Errorf("VFs %v of an earlier import imported again", vfList)
+	}
+	if _, err := os.Stat(filepath.Join(dir, importedDir, vfsDir)); err != nil {
+		t.Errorf("VF records not moved aside: %v", err)
+	}
+}
+
+// a config.json as written before the schema was versioned
+const baselineNetworkConfig = `{"Version":0,"Netdevice":"ens2f0","Mode":"sriov","Gateway":"192.168.1.1","vlan":100,"Privileged":true,"Prefix":"eth"}`
+
+func writeNetworkConfig(t *testing.T, dir string, nid string, config string) {
+	err := os.MkdirAll(filepath.Join(dir, nid), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, nid, "config.json"), []byte(config), 0644)
+	}
+	if err != nil {
+		t.Fatalf("writing network config: %v", err)
+	}
+}
+
+func storeNwList(t *testing.T, s Store) map[string]*DbNetworkInfo {
+	var nwList map[string]*DbNetworkInfo
+	err := s.View(func(tx StoreTx) error {
+		var err error
+		nwList, err = tx.Networks()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Networks: %v", err)
+	}
+	return nwList
+}
+
+func TestStoreMigrateBaselineNetwork(t *testing.T) {
+	for _, backend := range []string{stateBackendFile, stateBackendBolt} {
+		dir := t.TempDir()
+		writeNetworkConfig(t, dir, testNetworkID, baselineNetworkConfig)
+		s, err := OpenStore(backend, dir)
+		if err != nil {
+			t.Fatalf("OpenStore %s: %v", backend, err)
+		}
+		nw := storeNwList(t, s)[testNetworkID]
+		s.Close()
+		if nw == nil {
+			t.Errorf("%s: baseline network not read", backend)
+			continue
+		}
+		if nw.Netdev != "ens2f0" || nw.Vlan != 100 || !nw.Privileged || nw.Version != nwSchemaVersion {
+			t.Errorf("%s: baseline network read as %+v", backend, nw)
+		}
+	}
+}
+
+func TestStoreSkipNewerNetwork(t *testing.T) {
+	newer := fmt.Sprintf(`{"Version":%d,"Netdev":"ens2f0","Mode":"sriov"}`, nwSchemaVersion+1)
+
+	dir := t.TempDir()
+	writeNetworkConfig(t, dir, testNetworkID, newer)
+	for _, backend := range []string{stateBackendFile, stateBackendBolt} {
+		s, err := OpenStore(backend, dir)
+		if err != nil {
+			t.Fatalf("OpenStore %s: %v", backend, err)
+		}
+		nwList := storeNwList(t, s)
+		s.Close()
+		if len(nwList) != 0 {
+			t.Errorf("%s: newer network read as %+v", backend, nwList[testNetworkID])
+		}
+		rawData, err := ioutil.ReadFile(filepath.Join(dir, testNetworkID, "config.json"))
+		if err != nil || string(rawData) != newer {
+			t.Errorf("%s: newer network config changed to %s, %v", backend, rawData, err)
+		}
+	}
+
+	dir = t.TempDir()
+	s, err := OpenStore(stateBackendBolt, dir)
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	defer s.Close()
+	err = s.(*boltStore).db.Update(func(tx *bolt.Tx) error {
+		nwBucket, err := tx.Bucket(boltNetworksBucket).CreateBucket([]byte(testNetworkID))
+		if err != nil {
+			return err
+		}
+		return nwBucket.Put(boltConfigKey, []byte(newer))
+	})
+	if err != nil {
+		t.Fatalf("writing newer network: %v", err)
+	}
+	if nwList := storeNwList(t, s); len(nwList) != 0 {
+		t.Errorf("newer network read from the database as %+v", nwList[testNetworkID])
+	}
+}
@@ -0,0 +1,36 @@
+// Package cpulist parses the cpu lists of the kernel, as found in sysfs
+// and in the cpuset of containers.
+package cpulist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse parses a kernel cpu list such as "0-3,8,10-11".
+func Parse(cpuList string) ([]int, error) {
+	var cpus []int
+
+	for _, item := range strings.Split(strings.TrimSpace(cpuList), ",") {
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q", cpuList)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpu list %q", cpuList)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,538 @@
+// Package fakehw provides in-memory PFs and VFs implementing the Hardware
+// of the driver, for running the driver in tests without a NIC.
+package fakehw
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/k8snetworkplumbingwg/sriovnet"
+	"github.com/vishvananda/netlink"
+
+	"github.com/FoxDenHome/docker-sriov-plugin/internal/cpulist"
+)
+
+const (
+	fakeVfDriver    = "mlx5_core"
+	fakeVfHopLimit  = 64
+	fakeLinkSpeed   = 100000
+	fakeNumaCpuList = "0-15"
+
+	vfioPciDriver = "vfio-pci"
+)
+
+// Hardware is an in-memory driver.Hardware whose PFs and VFs behave like
+// their kernel counterparts, so that the driver can run without a NIC.
+type Hardware struct {
+	sync.Mutex
+
+	// PFs by netdevice name
+	Pfs map[string]*Pf
+	// cpu list of each NUMA node
+	NumaCpus map[int]string
+
+	nextIommuGroup int
+}
+
+type Pf struct {
+	Name       string
+	PciAddress string
+	MacAddress string
+	Speed      int
+	NumaNode   int
+	TotalVfs   int
+	Vfs        []*Vf
+	// RDMA device of the PF, none when empty
+	RdmaDevice string
+
+	bus int
+}
+
+type Vf struct {
+	Index      int
+	PciAddress string
+	// netdevice of the VF, empty while it is bound to vfio-pci
+	Netdev     string
+	MacAddress string
+	Driver     string
+	IommuGroup string
+	HopLimit   uint8
+	// VF configuration as reported by the PF
+	Info netlink.VfInfo
+	// error returned when the VF configuration is reset
+	FailReset error
+}
+
+func New() *Hardware {
+	return &Hardware{
+		Pfs:      make(map[string]*Pf),
+		NumaCpus: map[int]string{0: fakeNumaCpuList},
+	}
+}
+
+// AddPf adds a PF supporting totalVfs VFs, numVfs of which are enabled.
+func (hw *Hardware) AddPf(name string, totalVfs int, numVfs int) *Pf {
+	hw.Lock()
+	defer hw.Unlock()
+
+	bus := len(hw.Pfs) + 1
+	pf := &Pf{
+		Name:       name,
+		PciAddress: fmt.Sprintf("0000:%02x:00.0", bus),
+		MacAddress: fmt.Sprintf("02:00:00:%02x:00:00", bus),
+		Speed:      fakeLinkSpeed,
+		TotalVfs:   totalVfs,
+		RdmaDevice: fmt.Sprintf("mlx5_%d", bus-1),
+		bus:        bus,
+	}
+	hw.Pfs[name] = pf
+	hw.enableVfs(pf, numVfs)
+	return pf
+}
+
+// RenamePf renames the netdevice of a PF, like udev does when the naming
+// scheme changes. Its VFs keep their netdevices.
+func (hw *Hardware) RenamePf(name string, newName string) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf := hw.Pfs[name]
+	delete(hw.Pfs, name)
+	pf.Name = newName
+	hw.Pfs[newName] = pf
+}
+
+func (hw *Hardware) enableVfs(pf *Pf, numVfs int) {
+	pf.Vfs = nil
+	for i := 0; i < numVfs; i++ {
+		hw.nextIommuGroup++
+		vf := &Vf{
+			Index:      i,
+			PciAddress: fmt.Sprintf("0000:%02x:%02x.%d", pf.bus, 1+i/8, i%8),
+			Netdev:     fmt.Sprintf("%sv%d", pf.Name, i),
+			MacAddress: fmt.Sprintf("02:00:00:%02x:01:%02x", pf.bus, i),
+			Driver:     fakeVfDriver,
+			IommuGroup: strconv.Itoa(hw.nextIommuGroup),
+			HopLimit:   fakeVfHopLimit,
+		}
+		vf.Info = netlink.VfInfo{
+			ID:       i,
+			Mac:      net.HardwareAddr{0, 0, 0, 0, 0, 0},
+			Spoofchk: true,
+		}
+		pf.Vfs = append(pf.Vfs, vf)
+	}
+}
+
+func (hw *Hardware) getPf(name string) (*Pf, error) {
+	pf := hw.Pfs[name]
+	if pf == nil {
+		return nil, fmt.Errorf("device %s not found", name)
+	}
+	return pf, nil
+}
+
+func (hw *Hardware) getVf(pfName string, vfIndex int) (*Vf, error) {
+	pf, err := hw.getPf(pfName)
+	if err != nil {
+		return nil, err
+	}
+	if vfIndex < 0 || vfIndex >= len(pf.Vfs) {
+		return nil, fmt.Errorf("vf %d not found on %s", vfIndex, pfName)
+	}
+	return pf.Vfs[vfIndex], nil
+}
+
+func (hw *Hardware) getVfBy(match func(vf *Vf) bool) (*Vf, error) {
+	for _, pf := range hw.Pfs {
+		for _, vf := range pf.Vfs {
+			if match(vf) {
+				return vf, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("vf not found")
+}
+
+func (hw *Hardware) GetPfNetdevs() ([]string, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	var names []string
+	for name := range hw.Pfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (hw *Hardware) NetdevExists(name string) bool {
+	hw.Lock()
+	defer hw.Unlock()
+
+	if hw.Pfs[name] != nil {
+		return true
+	}
+	_, err := hw.getVfBy(func(vf *Vf) bool { return vf.Netdev != "" && vf.Netdev == name })
+	return err == nil
+}
+
+func (hw *Hardware) GetNetdevByPciAddress(pciAddr string) (string, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	for _, pf := range hw.Pfs {
+		if pf.PciAddress == pciAddr {
+			return pf.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no netdevice found for PCI device %s", pciAddr)
+}
+
+func (hw *Hardware) GetNetdevByMacAddress(macAddr string) (string, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	for _, pf := range hw.Pfs {
+		if pf.MacAddress == macAddr {
+			return pf.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no netdevice found with mac address %s", macAddr)
+}
+
+func (hw *Hardware) GetPciAddress(name string) (string, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(name)
+	if err != nil {
+		return "", err
+	}
+	return pf.PciAddress, nil
+}
+
+func (hw *Hardware) GetLinkSpeed(name string) (int, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(name)
+	if err != nil {
+		return 0, err
+	}
+	return pf.Speed, nil
+}
+
+func (hw *Hardware) GetNumaNode(name string) int {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(name)
+	if err != nil {
+		return -1
+	}
+	return pf.NumaNode
+}
+
+func (hw *Hardware) GetRdmaDevice(name string) (string, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(name)
+	if err != nil {
+		return "", err
+	}
+	if pf.RdmaDevice == "" {
+		return "", fmt.Errorf("no RDMA device for %s", name)
+	}
+	return pf.RdmaDevice, nil
+}
+
+func (hw *Hardware) GetCpuListNumaNode(cpuList string) (int, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	cpus, err := cpulist.Parse(cpuList)
+	if err != nil {
+		return -1, err
+	}
+
+	bestNode := -1
+	bestCount := 0
+	for node, nodeCpuList := range hw.NumaCpus {
+		nodeCpus, err := cpulist.Parse(nodeCpuList)
+		if err != nil {
+			return -1, err
+		}
+		count := 0
+		for _, cpu := range cpus {
+			for _, nodeCpu := range nodeCpus {
+				if cpu == nodeCpu {
+					count++
+				}
+			}
+		}
+		if count > bestCount || (count == bestCount && count > 0 && node < bestNode) {
+			bestNode = node
+			bestCount = count
+		}
+	}
+	return bestNode, nil
+}
+
+func (hw *Hardware) IsSriovEnabled(pfName string) bool {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(pfName)
+	return err == nil && len(pf.Vfs) > 0
+}
+
+func (hw *Hardware) GetTotalVfCount(pfName string) (int, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(pfName)
+	if err != nil {
+		return 0, err
+	}
+	return pf.TotalVfs, nil
+}
+
+func (hw *Hardware) SetEnabledVfCount(pfName string, vfCount int) error {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(pfName)
+	if err != nil {
+		return err
+	}
+	if vfCount > pf.TotalVfs {
+		return fmt.Errorf("%s supports at most %d VFs", pfName, pf.TotalVfs)
+	}
+	// like the kernel, VFs must be disabled before changing their number
+	if vfCount > 0 && len(pf.Vfs) > 0 && vfCount != len(pf.Vfs) {
+		return fmt.Errorf("device or resource busy")
+	}
+	hw.enableVfs(pf, vfCount)
+	return nil
+}
+
+func (hw *Hardware) GetPfHandle(pfName string) (*sriovnet.PfNetdevHandle, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(pfName)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := sriovnet.PfNetdevHandle{PfNetdevName: pfName}
+	for _, vf := range pf.Vfs {
+		handle.List = append(handle.List, &sriovnet.VfObj{
+			Index:      vf.Index,
+			PciAddress: vf.PciAddress,
+			Bound:      vf.Netdev != "",
+		})
+	}
+	return &handle, nil
+}
+
+func (hw *Hardware) GetVfNetdevName(pfName string, vfIndex int) string {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVf(pfName, vfIndex)
+	if err != nil {
+		return ""
+	}
+	return vf.Netdev
+}
+
+func (hw *Hardware) GetVfMacAddress(pfName string, vfIndex int) (string, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVf(pfName, vfIndex)
+	if err != nil {
+		return "", err
+	}
+	if vf.Netdev == "" {
+		return "", fmt.Errorf("vf %d of %s has no netdevice", vfIndex, pfName)
+	}
+	return vf.MacAddress, nil
+}
+
+func (hw *Hardware) GetVfInfo(pfName string, vfIndex int) (*netlink.VfInfo, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVf(pfName, vfIndex)
+	if err != nil {
+		return nil, err
+	}
+	info := vf.Info
+	return &info, nil
+}
+
+func (hw *Hardware) GetVfInfos(pfName string) ([]netlink.VfInfo, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	pf, err := hw.getPf(pfName)
+	if err != nil {
+		return nil, err
+	}
+	var infos []netlink.VfInfo
+	for _, vf := range pf.Vfs {
+		infos = append(infos, vf.Info)
+	}
+	return infos, nil
+}
+
+func (hw *Hardware) SetVfVlan(pfName string, vfIndex int, vlan int) error {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVf(pfName, vfIndex)
+	if err != nil {
+		return err
+	}
+	vf.Info.Vlan = vlan
+	return nil
+}
+
+func (hw *Hardware) SetVfPrivileged(pfName string, vfIndex int, privileged bool) error {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVf(pfName, vfIndex)
+	if err != nil {
+		return err
+	}
+	vf.Info.Spoofchk = !privileged
+	vf.Info.Trust = 0
+	if privileged {
+		vf.Info.Trust = 1
+	}
+	return nil
+}
+
+func (hw *Hardware) SetVfRate(pfName string, vfIndex int, minRate int, maxRate int) error {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVf(pfName, vfIndex)
+	if err != nil {
+		return err
+	}
+	vf.Info.MinTxRate = uint32(minRate)
+	vf.Info.MaxTxRate = uint32(maxRate)
+	return nil
+}
+
+func (hw *Hardware) ResetVfConfig(pfName string, vfIndex int, mac net.HardwareAddr) error {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVf(pfName, vfIndex)
+	if err != nil {
+		return err
+	}
+	if vf.FailReset != nil {
+		return vf.FailReset
+	}
+	vf.Info.Vlan = 0
+	vf.Info.Qos = 0
+	vf.Info.MinTxRate = 0
+	vf.Info.MaxTxRate = 0
+	vf.Info.Trust = 0
+	vf.Info.Spoofchk = true
+	if mac != nil {
+		vf.Info.Mac = mac
+	}
+	return nil
+}
+
+func (hw *Hardware) GetRoceHopLimit(vfNetdev string) (uint8, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVfBy(func(vf *Vf) bool { return vf.Netdev != "" && vf.Netdev == vfNetdev })
+	if err != nil {
+		return 0, fmt.Errorf("no rdma device for %s", vfNetdev)
+	}
+	return vf.HopLimit, nil
+}
+
+func (hw *Hardware) SetRoceHopLimit(vfNetdev string, hopLimit uint8) error {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVfBy(func(vf *Vf) bool { return vf.Netdev != "" && vf.Netdev == vfNetdev })
+	if err != nil {
+		return fmt.Errorf("no rdma device for %s", vfNetdev)
+	}
+	vf.HopLimit = hopLimit
+	return nil
+}
+
+func (hw *Hardware) getVfByPciAddress(pciAddr string) (*Vf, error) {
+	vf, err := hw.getVfBy(func(vf *Vf) bool { return vf.PciAddress == pciAddr })
+	if err != nil {
+		return nil, fmt.Errorf("PCI device %s not found", pciAddr)
+	}
+	return vf, nil
+}
+
+func (hw *Hardware) BindVfio(pciAddr string) (string, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVfByPciAddress(pciAddr)
+	if err != nil {
+		return "", err
+	}
+	origDriver := vf.Driver
+	vf.Driver = vfioPciDriver
+	vf.Netdev = ""
+	return origDriver, nil
+}
+
+func (hw *Hardware) BindDriver(pciAddr string, driver string) error {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVfByPciAddress(pciAddr)
+	if err != nil {
+		return err
+	}
+	if driver == "" {
+		driver = fakeVfDriver
+	}
+	vf.Driver = driver
+	if driver != vfioPciDriver {
+		for _, pf := range hw.Pfs {
+			for _, pfVf := range pf.Vfs {
+				if pfVf == vf {
+					vf.Netdev = fmt.Sprintf("%sv%d", pf.Name, vf.Index)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (hw *Hardware) GetIommuGroup(pciAddr string) (string, error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	vf, err := hw.getVfByPciAddress(pciAddr)
+	if err != nil {
+		return "", err
+	}
+	return vf.IommuGroup, nil
+}
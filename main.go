@@ -1,29 +1,188 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
+	"net/http"
 	"os"
-
-	"github.com/docker/go-plugins-helpers/network"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/FoxDenHome/docker-sriov-plugin/driver"
+	"github.com/sirupsen/logrus"
 )
 
 var version = "DEV"
 
+// time requests in flight get to complete on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// networkDefaults collects -network-default key=value flags.
+type networkDefaults map[string]string
+
+func (defaults networkDefaults) String() string {
+	var items []string
+	for key, value := range defaults {
+		items = append(items, key+"="+value)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (defaults networkDefaults) Set(item string) error {
+	kv := strings.SplitN(item, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected key=value")
+	}
+	defaults[kv[0]] = kv[1]
+	return nil
+}
+
+var defaultConfig = driver.DefaultConfig()
+
+var (
+	configFlagSet  = addConfigFlags(flag.CommandLine)
+	metricsAddress = flag.String("metrics-address", defaultConfig.MetricsAddress,
+		"TCP address Prometheus metrics are served on, such as :9310")
+	logLevel          = flag.String("log-level", defaultConfig.LogLevel, "debug, info, warn or error, debug logs every request")
+	logFormat         = flag.String("log-format", defaultConfig.LogFormat, "text (logfmt) or json")
+	reconcileInterval = flag.Duration("reconcile-interval", defaultConfig.ReconcileInterval,
+		"interval networks and endpoints are reconciled with Docker at")
+	retryInterval = flag.Duration("retry-interval", defaultConfig.RetryInterval,
+		"interval Docker is retried at while it is unreachable")
+	networkDefaultFlags = networkDefaults{}
+)
+
+func init() {
+	flag.Var(networkDefaultFlags, "network-default",
+		"default of a network option as key=value, such as prefix=ib, may be repeated")
+}
+
+// loadConfig reads the config file if one is given, and overrides its
+// settings with the flags given.
+func loadConfig() (*driver.Config, error) {
+	config, err := configFlagSet.load()
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "metrics-address":
+			config.MetricsAddress = *metricsAddress
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "log-format":
+			config.LogFormat = *logFormat
+		case "reconcile-interval":
+			config.ReconcileInterval = *reconcileInterval
+		case "retry-interval":
+			config.RetryInterval = *retryInterval
+		case "network-default":
+			for key, value := range networkDefaultFlags {
+				config.NetworkDefaults[key] = value
+			}
+		}
+	})
+	return config, config.Validate()
+}
+
 func main() {
-	d, err := driver.StartDriver()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] | <command> [flags] [args]\n", os.Args[0])
+		flag.PrintDefaults()
+		commandUsage(os.Stderr)
+	}
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		logrus.Fatalf("Config error: %s", err.Error())
+	}
+	driver.SetLogFormat(config.LogFormat)
+
+	d, err := driver.StartDriver(config)
 	if err != nil {
-		panic(err)
+		logrus.Fatalf("Start driver error: %s", err.Error())
+	}
+	server := driver.NewServer(d, config.Socket)
+	adminServer := driver.NewAdminServer(d, config.AdminSocketPath())
+	controlServer := driver.NewControlServer(d, config.ControlSocketPath())
+	var metricsServer *http.Server
+	if config.MetricsAddress != "" {
+		metricsServer = driver.NewMetricsServer(d, config.MetricsAddress)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				logrus.Infof("Received %v, reloading config and reconciling with Docker", sig)
+				config, err := loadConfig()
+				if err != nil {
+					logrus.WithError(err).Error("Config error, keeping the current config")
+				} else {
+					d.Reload(config)
+				}
+				d.TriggerReconcile()
+				continue
+			}
+			logrus.Infof("Received %v, shutting down", sig)
+			adminServer.Close()
+			controlServer.Close()
+			if metricsServer != nil {
+				metricsServer.Close()
+			}
+			err := server.Shutdown(shutdownTimeout)
+			if err != nil {
+				logrus.WithError(err).Error("Shutdown error")
+			}
+		}
+	}()
+
+	go func() {
+		err := adminServer.Serve()
+		if err != nil {
+			logrus.WithError(err).Error("Admin API error")
+		}
+	}()
+
+	go func() {
+		err := controlServer.Serve()
+		if err != nil {
+			logrus.WithError(err).Error("Control API error")
+		}
+	}()
+
+	if metricsServer != nil {
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logrus.WithError(err).Error("Metrics error")
+			}
+		}()
 	}
-	h := network.NewHandler(d)
 
-	log.Printf("Docker sriov plugin started version=%v\n", version)
-	log.Printf("Ready to accept commands.\n")
+	logrus.WithFields(logrus.Fields{
+		"version": version,
+		"socket":  config.Socket,
+		"admin":   config.AdminSocketPath(),
+		"control": config.ControlSocketPath(),
+		"state":   config.StateDir,
+	}).Info("Docker sriov plugin started")
+	logrus.Info("Ready to accept commands.")
 
-	err = h.ServeUnix("sriov", 0)
+	err = server.Serve()
 	if err != nil {
-		log.Fatalf("Run app error: %s", err.Error())
-		os.Exit(1)
+		logrus.Fatalf("Run app error: %s", err.Error())
 	}
+	logrus.Info("Docker sriov plugin stopped")
 }